@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Admin roles managed Postgres providers hand out instead of superuser
+var managedAdminRoles = []string{
+	"rds_superuser",     // Amazon RDS and Aurora
+	"cloudsqlsuperuser", // Google Cloud SQL
+	"azure_pg_admin",    // Azure Database for PostgreSQL Flexible Server
+	"supabase_admin",    // Supabase
+	"neon_superuser",    // Neon
+}
+
+// What the current user is allowed to do, probed once per run
+type Capabilities struct {
+	CurrentUser   string
+	ServerVersion int
+	Superuser     bool
+
+	// ALTER SYSTEM on the WAL settings, a superuser or a PG15+ parameter grant
+	AlterSystem bool
+	// CREATEROLE, needed for the replication user
+	CreateRole bool
+	// How the REPLICATION right is given to the replication user: "attribute"
+	// for the REPLICATION role attribute, "rds_replication" for membership in
+	// the RDS role, empty if the current user can't give it at all
+	ReplicationGrant string
+	// Creating replication slots needs REPLICATION or rds_replication
+	CreateSlot bool
+	// CREATE on the database, needed for the exoquic schema and the publication
+	CreateOnDatabase bool
+
+	// Provider admin roles the current user is a member of
+	ManagedRoles []string
+	// Where the server runs
+	Provider Provider
+}
+
+// Whether a role exists and has the REPLICATION right, either through the
+// attribute or, on RDS, through membership in rds_replication
+const replicationRoleQuery = `
+	SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1),
+		COALESCE((
+			SELECT r.rolreplication OR EXISTS(
+				SELECT 1 FROM pg_roles g
+				WHERE g.rolname = 'rds_replication' AND pg_has_role(r.oid, g.oid, 'MEMBER'))
+			FROM pg_roles r
+			WHERE r.rolname = $1
+		), false)
+`
+
+// Probe the rights each configuration step needs
+func probeCapabilities(db *sql.DB) (Capabilities, error) {
+	var caps Capabilities
+
+	var createRole, replication bool
+	err := db.QueryRow(`
+		SELECT current_user, current_setting('server_version_num')::int, rolsuper, rolcreaterole, rolreplication,
+			has_database_privilege(current_database(), 'CREATE')
+		FROM pg_roles
+		WHERE rolname = current_user
+	`).Scan(&caps.CurrentUser, &caps.ServerVersion, &caps.Superuser, &createRole, &replication, &caps.CreateOnDatabase)
+	if err != nil {
+		return caps, fmt.Errorf("failed to check role attributes: %v", err)
+	}
+
+	rows, err := db.Query(`
+		SELECT rolname FROM pg_roles
+		WHERE rolname = ANY($1) AND pg_has_role(current_user, oid, 'MEMBER')
+		ORDER BY rolname
+	`, pq.Array(append(managedAdminRoles, "rds_replication")))
+	if err != nil {
+		return caps, fmt.Errorf("failed to check role memberships: %v", err)
+	}
+	defer rows.Close()
+
+	rdsReplication := false
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return caps, fmt.Errorf("failed to scan row: %v", err)
+		}
+		if role == "rds_replication" {
+			rdsReplication = true
+			continue
+		}
+		caps.ManagedRoles = append(caps.ManagedRoles, role)
+	}
+
+	if err := rows.Err(); err != nil {
+		return caps, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	caps.CreateRole = caps.Superuser || createRole
+	caps.CreateSlot = caps.Superuser || replication || rdsReplication
+
+	switch {
+	case caps.Superuser:
+		caps.ReplicationGrant = "attribute"
+	case caps.hasManagedRole("rds_superuser"):
+		// RDS doesn't allow the attribute, the rds_replication role grants the right
+		caps.ReplicationGrant = "rds_replication"
+	case createRole && replication && caps.ServerVersion >= 160000:
+		// Since PG16 a CREATEROLE user can give the attributes it has itself
+		caps.ReplicationGrant = "attribute"
+	case createRole && replication && len(caps.ManagedRoles) > 0:
+		// Cloud SQL, Azure and Supabase let their admin role give REPLICATION
+		caps.ReplicationGrant = "attribute"
+	}
+
+	caps.Provider, err = detectProvider(db)
+	if err != nil {
+		return caps, err
+	}
+
+	caps.AlterSystem = caps.Superuser
+	if !caps.AlterSystem && caps.ServerVersion >= 150000 {
+		err = db.QueryRow(`
+			SELECT has_parameter_privilege('wal_level', 'ALTER SYSTEM')
+				AND has_parameter_privilege('max_replication_slots', 'ALTER SYSTEM')
+				AND has_parameter_privilege('max_wal_senders', 'ALTER SYSTEM')
+		`).Scan(&caps.AlterSystem)
+		if err != nil {
+			return caps, fmt.Errorf("failed to check ALTER SYSTEM privileges: %v", err)
+		}
+	}
+
+	return caps, nil
+}
+
+func (c Capabilities) hasManagedRole(role string) bool {
+	for _, r := range c.ManagedRoles {
+		if r == role {
+			return true
+		}
+	}
+	return false
+}
+
+// Summarize the probed rights for the log
+func (c Capabilities) String() string {
+	if c.Superuser {
+		return "superuser"
+	}
+
+	var rights []string
+	for _, right := range []struct {
+		name    string
+		granted bool
+	}{
+		{"ALTER SYSTEM", c.AlterSystem},
+		{"CREATEROLE", c.CreateRole},
+		{"grant REPLICATION", c.ReplicationGrant != ""},
+		{"create replication slots", c.CreateSlot},
+		{"CREATE on database", c.CreateOnDatabase},
+	} {
+		state := "no"
+		if right.granted {
+			state = "yes"
+		}
+		rights = append(rights, fmt.Sprintf("%s: %s", right.name, state))
+	}
+
+	summary := strings.Join(rights, ", ")
+	if len(c.ManagedRoles) > 0 {
+		summary += fmt.Sprintf(" (member of %s)", strings.Join(c.ManagedRoles, ", "))
+	}
+	return summary
+}
+
+// Provider-specific instructions for a step the current user can't run
+func manualInstructions(caps Capabilities, step string, statements ...string) string {
+	var result strings.Builder
+
+	switch step {
+	case "replication":
+		switch {
+		case caps.hasManagedRole("cloudsqlsuperuser"), caps.hasManagedRole("azure_pg_admin"), caps.hasManagedRole("supabase_admin"):
+			result.WriteString("Run the following as the provider's admin user:")
+		default:
+			result.WriteString("Ask a superuser to run the following:")
+		}
+	case "owner":
+		result.WriteString("Run the following as the owner of the table:")
+	default:
+		result.WriteString("Ask a user with the required privileges to run the following:")
+	}
+
+	for _, statement := range statements {
+		result.WriteString("\n  " + statement + ";")
+	}
+	return result.String()
+}
@@ -0,0 +1,523 @@
+package main
+
+import (
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+func printUsage() {
+	fmt.Fprintf(os.Stderr, `Usage: exoquic-configurer [command] [flags]
+
+Commands:
+  plan      Show what apply would change without modifying the database, exits 1 if a step failed (-output text|json)
+  apply     Configure the database for Exoquic (default), exits 3 if a server restart is still pending (-timeout)
+  status    Show the current replication status
+  verify    Check that the database is correctly configured, exits 1 if not
+  monitor   Log the lag of the replication slot periodically and alert on thresholds
+  heartbeat Update exoquic.heartbeat periodically so the slot advances on idle databases
+  teardown  Remove everything created by apply (-yes to confirm, -restore to undo setting changes)
+
+The database connection is configured through environment variables, see README.md.
+`)
+}
+
+// A single verifiable aspect of the Exoquic configuration
+type check struct {
+	Name     string
+	Current  string
+	Expected string
+	OK       bool
+}
+
+// Compare the current database state with the state apply produces
+func runChecks(db *sql.DB, config Config) ([]check, error) {
+	var checks []check
+
+	settings, err := querySettings(db, walSettingNames)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check WAL settings: %v", err)
+	}
+
+	walLevel := settings["wal_level"].Setting
+	checks = append(checks, check{
+		Name:     "wal_level",
+		Current:  walLevel,
+		Expected: "logical",
+		OK:       walLevel == "logical",
+	})
+
+	targets, err := computeWALTargets(db, config.SlotName, config.walTuning())
+	if err != nil {
+		return nil, err
+	}
+	for _, setting := range []struct {
+		name   string
+		target int
+	}{
+		{"max_replication_slots", targets.MaxReplicationSlots},
+		{"max_wal_senders", targets.MaxWalSenders},
+	} {
+		value, err := settings[setting.name].intValue()
+		if err != nil {
+			return nil, fmt.Errorf("failed to check %s: %v", setting.name, err)
+		}
+		checks = append(checks, check{
+			Name:     setting.name,
+			Current:  fmt.Sprintf("%d", value),
+			Expected: fmt.Sprintf(">= %d", setting.target),
+			OK:       value >= setting.target,
+		})
+	}
+
+	pending := pendingSettings(settings, walSettingNames)
+	checks = append(checks, check{
+		Name:     "settings pending restart",
+		Current:  valueOrNone(describePendingSettings(pending)),
+		Expected: "(none)",
+		OK:       len(pending) == 0,
+	})
+
+	var schemaExists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = 'exoquic')").Scan(&schemaExists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if schema exists: %v", err)
+	}
+	checks = append(checks, existenceCheck("schema exoquic", schemaExists))
+
+	var userExists, canReplicate bool
+	err = db.QueryRow(replicationRoleQuery, config.ReplicationUser).Scan(&userExists, &canReplicate)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if user exists: %v", err)
+	}
+	checks = append(checks, existenceCheck("role "+config.ReplicationUser, userExists))
+	if userExists {
+		checks = append(checks, check{
+			Name:     "role " + config.ReplicationUser + " replication",
+			Current:  fmt.Sprintf("%t", canReplicate),
+			Expected: "true",
+			OK:       canReplicate,
+		})
+	}
+
+	var publicationExists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_publication WHERE pubname = $1)", config.PublicationName).Scan(&publicationExists)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check if publication exists: %v", err)
+	}
+	checks = append(checks, existenceCheck("publication "+config.PublicationName, publicationExists))
+	if publicationExists && config.Heartbeat {
+		var heartbeatPublished bool
+		err = db.QueryRow(`
+			SELECT EXISTS(SELECT 1 FROM pg_publication_tables
+				WHERE pubname = $1 AND schemaname = 'exoquic' AND tablename = 'heartbeat')
+		`, config.PublicationName).Scan(&heartbeatPublished)
+		if err != nil {
+			return nil, fmt.Errorf("failed to check if the heartbeat table is published: %v", err)
+		}
+		checks = append(checks, check{
+			Name:     heartbeatTable + " published",
+			Current:  fmt.Sprintf("%t", heartbeatPublished),
+			Expected: "true",
+			OK:       heartbeatPublished,
+		})
+	}
+
+	var slotPlugin sql.NullString
+	err = db.QueryRow("SELECT plugin FROM pg_replication_slots WHERE slot_name = $1", config.SlotName).Scan(&slotPlugin)
+	if err != nil && err != sql.ErrNoRows {
+		return nil, fmt.Errorf("failed to check if replication slot exists: %v", err)
+	}
+	checks = append(checks, existenceCheck("replication slot "+config.SlotName, err == nil))
+	if err == nil {
+		checks = append(checks, check{
+			Name:     "replication slot " + config.SlotName + " plugin",
+			Current:  slotPlugin.String,
+			Expected: "pgoutput",
+			OK:       slotPlugin.String == "pgoutput",
+		})
+
+		retention, ok, err := querySlotRetention(db, config.SlotName)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			checks = append(checks, check{
+				Name:     "replication slot " + config.SlotName + " wal_status",
+				Current:  retention.WALStatus,
+				Expected: "reserved or extended",
+				OK:       retention.WALStatus == "reserved" || retention.WALStatus == "extended",
+			})
+		}
+	}
+
+	schemas, _, err := resolveSchemas(db, config)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := db.Query(`
+		SELECT n.nspname, c.relname, c.relreplident
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind = 'r'
+			AND n.nspname = ANY($1)
+			AND NOT EXISTS (
+				SELECT 1 FROM pg_constraint
+				WHERE conrelid = c.oid AND contype = 'p'
+			)
+	`, pq.Array(schemas))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tables without primary keys: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var schemaName, tableName, replicaIdentity string
+		if err := rows.Scan(&schemaName, &tableName, &replicaIdentity); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		checks = append(checks, check{
+			Name:     fmt.Sprintf("table %s.%s replica identity", schemaName, tableName),
+			Current:  replicaIdentityName(replicaIdentity),
+			Expected: "full",
+			OK:       replicaIdentity == "f",
+		})
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	return checks, nil
+}
+
+func existenceCheck(name string, exists bool) check {
+	current := "missing"
+	if exists {
+		current = "present"
+	}
+	return check{Name: name, Current: current, Expected: "present", OK: exists}
+}
+
+// Translate pg_class.relreplident into the keyword used by ALTER TABLE
+func replicaIdentityName(relreplident string) string {
+	switch relreplident {
+	case "d":
+		return "default"
+	case "n":
+		return "nothing"
+	case "f":
+		return "full"
+	case "i":
+		return "index"
+	}
+	return relreplident
+}
+
+// Show what apply would change without touching the database
+func runPlan(config Config, args []string) {
+	flags := flag.NewFlagSet("plan", flag.ExitOnError)
+	format := flags.String("output", "text", "output format: text or json")
+	flags.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		log.Fatalf("Unknown output format %q, expected text or json", *format)
+	}
+
+	if err := validateConfig(config); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	db, caps := openAdminConnection(config)
+	defer db.Close()
+
+	// The step reports describe changes as if they were made, the plan is the output here
+	plan := &Plan{DryRun: true}
+	var report strings.Builder
+	failed := configureDatabase(db, config, caps, plan, &report)
+
+	if *format == "json" {
+		output, err := plan.JSON()
+		if err != nil {
+			log.Fatalf("Error rendering plan: %v", err)
+		}
+		fmt.Print(output)
+	} else {
+		var output strings.Builder
+		output.WriteString("Exoquic PostgreSQL Configuration Plan\n")
+		output.WriteString("=====================================\n\n")
+		output.WriteString(plan.String())
+		fmt.Print(output.String())
+	}
+
+	// A failed step leaves its changes out of the plan, so the plan is incomplete
+	if failed {
+		db.Close()
+		os.Exit(exitFailed)
+	}
+}
+
+// Show the current replication status
+func runStatus(config Config, args []string) {
+	flags := flag.NewFlagSet("status", flag.ExitOnError)
+	flags.Parse(args)
+
+	if err := validateConfig(config); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	db, err := connectWithRetry(config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer db.Close()
+
+	status, err := replicationStatus(db, config)
+	if err != nil {
+		log.Fatalf("Error reading replication status: %v", err)
+	}
+
+	fmt.Print(status)
+}
+
+// Describe the replication slot and publication used by Exoquic
+func replicationStatus(db *sql.DB, config Config) (string, error) {
+	var result strings.Builder
+
+	result.WriteString("Exoquic Replication Status\n")
+	result.WriteString("==========================\n\n")
+
+	settings, err := querySettings(db, walSettingNames)
+	if err != nil {
+		return "", fmt.Errorf("failed to check WAL settings: %v", err)
+	}
+	result.WriteString(fmt.Sprintf("wal_level: %s\n", settings["wal_level"].Setting))
+	for _, s := range pendingSettings(settings, walSettingNames) {
+		result.WriteString("pending restart: " + s.describePending() + "\n")
+	}
+	result.WriteString("\n")
+
+	var schemaExists bool
+	err = db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = 'exoquic')").Scan(&schemaExists)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if schema exists: %v", err)
+	}
+	if schemaExists {
+		var database string
+		var publications, slots, replications int
+		err = db.QueryRow(`
+			SELECT database_name, publication_count, replication_slot_count, active_replication_count
+			FROM exoquic.status
+		`).Scan(&database, &publications, &slots, &replications)
+		if err != nil {
+			return "", fmt.Errorf("failed to query exoquic.status: %v", err)
+		}
+		result.WriteString(fmt.Sprintf("Database: %s\n", database))
+		result.WriteString(fmt.Sprintf("Publications: %d\n", publications))
+		result.WriteString(fmt.Sprintf("Replication slots: %d\n", slots))
+		result.WriteString(fmt.Sprintf("Active replications: %d\n\n", replications))
+	} else {
+		result.WriteString("The exoquic schema does not exist, run apply first.\n\n")
+	}
+
+	var plugin, restartLSN, confirmedFlushLSN sql.NullString
+	var active bool
+	err = db.QueryRow(`
+		SELECT plugin, active, restart_lsn::text, confirmed_flush_lsn::text
+		FROM pg_replication_slots
+		WHERE slot_name = $1
+	`, config.SlotName).Scan(&plugin, &active, &restartLSN, &confirmedFlushLSN)
+	if err == sql.ErrNoRows {
+		result.WriteString(fmt.Sprintf("Replication slot %s does not exist.\n", config.SlotName))
+	} else if err != nil {
+		return "", fmt.Errorf("failed to query replication slot: %v", err)
+	} else {
+		result.WriteString(fmt.Sprintf("Replication slot %s:\n", config.SlotName))
+		result.WriteString(fmt.Sprintf("  Plugin: %s\n", plugin.String))
+		result.WriteString(fmt.Sprintf("  Active: %t\n", active))
+		result.WriteString(fmt.Sprintf("  Restart LSN: %s\n", restartLSN.String))
+		result.WriteString(fmt.Sprintf("  Confirmed flush LSN: %s\n", confirmedFlushLSN.String))
+
+		retention, ok, err := querySlotRetention(db, config.SlotName)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			result.WriteString(fmt.Sprintf("  WAL status: %s\n", retention.WALStatus))
+			result.WriteString(fmt.Sprintf("  Retained WAL: %s\n", formatBytes(retention.RetainedBytes)))
+			if retention.SafeWALSize.Valid {
+				result.WriteString(fmt.Sprintf("  Safe WAL size: %s\n", formatBytes(retention.SafeWALSize.Int64)))
+			} else {
+				result.WriteString("  Safe WAL size: unlimited\n")
+			}
+			if warning := retention.warning(); warning != "" {
+				result.WriteString("  WARNING: " + warning + "\n")
+			}
+		}
+	}
+
+	var allTables bool
+	err = db.QueryRow("SELECT puballtables FROM pg_publication WHERE pubname = $1", config.PublicationName).Scan(&allTables)
+	if err == sql.ErrNoRows {
+		result.WriteString(fmt.Sprintf("Publication %s does not exist.\n", config.PublicationName))
+		return result.String(), nil
+	} else if err != nil {
+		return "", fmt.Errorf("failed to query publication: %v", err)
+	}
+
+	var tableCount int
+	err = db.QueryRow("SELECT count(*) FROM pg_publication_tables WHERE pubname = $1", config.PublicationName).Scan(&tableCount)
+	if err != nil {
+		return "", fmt.Errorf("failed to count publication tables: %v", err)
+	}
+	result.WriteString(fmt.Sprintf("Publication %s:\n", config.PublicationName))
+	result.WriteString(fmt.Sprintf("  All tables: %t\n", allTables))
+	result.WriteString(fmt.Sprintf("  Published tables: %d\n", tableCount))
+
+	options, err := queryPublicationOptions(db, config.PublicationName)
+	if err != nil {
+		return "", err
+	}
+	result.WriteString(fmt.Sprintf("  Publish: %s\n", strings.Join(options.Publish, ", ")))
+	result.WriteString(fmt.Sprintf("  Via partition root: %t\n", options.ViaPartitionRoot))
+
+	return result.String(), nil
+}
+
+// Check the configuration and exit with status 1 if anything is missing
+func runVerify(config Config, args []string) {
+	flags := flag.NewFlagSet("verify", flag.ExitOnError)
+	flags.Parse(args)
+
+	if err := validateConfig(config); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	db, err := connectWithRetry(config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer db.Close()
+
+	checks, err := runChecks(db, config)
+	if err != nil {
+		log.Fatalf("Error checking configuration: %v", err)
+	}
+
+	failed := 0
+	for _, c := range checks {
+		state := "OK"
+		if !c.OK {
+			state = "FAIL"
+			failed++
+		}
+		fmt.Printf("%-4s %s: %s (expected %s)\n", state, c.Name, c.Current, c.Expected)
+	}
+
+	if failed > 0 {
+		fmt.Printf("\n%d of %d checks failed.\n", failed, len(checks))
+		db.Close()
+		os.Exit(1)
+	}
+	fmt.Printf("\nAll %d checks passed.\n", len(checks))
+}
+
+// Remove the objects created by apply
+func runTeardown(config Config, args []string) {
+	flags := flag.NewFlagSet("teardown", flag.ExitOnError)
+	confirm := flags.Bool("yes", false, "confirm that the Exoquic configuration should be removed")
+	dryRun := flags.Bool("dry-run", false, "only show what teardown would remove")
+	restore := flags.Bool("restore", false, "restore the replica identities and WAL settings changed by apply")
+	format := flags.String("output", "text", "dry-run output format: text or json")
+	flags.Parse(args)
+
+	if *format != "text" && *format != "json" {
+		log.Fatalf("Unknown output format %q, expected text or json", *format)
+	}
+
+	if err := validateConfig(config); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+
+	db, _ := openAdminConnection(config)
+	defer db.Close()
+
+	// Without confirmation teardown only shows what it would remove
+	plan := &Plan{DryRun: *dryRun || !*confirm}
+	var output strings.Builder
+	failed := teardownDatabase(db, config, plan, *restore, &output)
+
+	if plan.DryRun {
+		if *format == "json" {
+			planOutput, err := plan.JSON()
+			if err != nil {
+				log.Fatalf("Error rendering plan: %v", err)
+			}
+			fmt.Print(planOutput)
+		} else {
+			fmt.Println("Exoquic PostgreSQL Teardown Plan")
+			fmt.Println("================================")
+			fmt.Println()
+			fmt.Print(plan.String())
+		}
+		// Showing the plan succeeded, 2 is left to usage errors
+		if !*dryRun {
+			fmt.Fprintln(os.Stderr, "\nRe-run with -yes to remove the Exoquic configuration.")
+		}
+		return
+	}
+
+	fmt.Println("Exoquic PostgreSQL Teardown Report")
+	fmt.Println("==================================")
+	fmt.Println()
+	fmt.Print(output.String())
+	if failed {
+		db.Close()
+		os.Exit(1)
+	}
+	log.Println("Teardown complete!")
+}
+
+// Run every teardown step, recording the changes in the plan. Reports whether any step failed.
+func teardownDatabase(db *sql.DB, config Config, plan *Plan, restore bool, output *strings.Builder) bool {
+	type step struct {
+		title string
+		run   func() (string, error)
+	}
+
+	// The slot is dropped first, wal_level is only restored once no logical slot is
+	// left. The previous state lives in the exoquic schema and has to be read before dropping it.
+	steps := []step{
+		{"Replication Slot", func() (string, error) { return dropReplicationSlot(db, plan, config.SlotName) }},
+		{"Publication", func() (string, error) { return dropPublication(db, plan, config.PublicationName) }},
+	}
+	if restore {
+		steps = append(steps, step{"Restore", func() (string, error) { return restorePreviousState(db, plan, config.SlotName) }})
+	}
+	steps = append(steps,
+		step{"Exoquic Schema", func() (string, error) { return dropExoquicSchema(db, plan) }},
+		step{"Replication User", func() (string, error) { return dropReplicationUser(db, plan, config.ReplicationUser) }},
+	)
+
+	failed := false
+	for _, step := range steps {
+		result, err := step.run()
+		if err != nil {
+			log.Printf("Warning: Error removing %s: %v", strings.ToLower(step.title), err)
+			failed = true
+			continue
+		}
+		output.WriteString(step.title + ":\n")
+		output.WriteString(strings.Repeat("-", len(step.title)) + "\n")
+		output.WriteString(result)
+		output.WriteString("\n")
+	}
+
+	return failed
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/url"
+	"strings"
+)
+
+// A connection setting that can come from DATABASE_URL or its own environment variable
+type connectionSetting struct {
+	env      string  // environment variable, also used as the key in Config.Sources
+	urlParam string  // libpq URI query parameter
+	field    *string // Config field holding the value
+}
+
+func connectionSettings(config *Config) []connectionSetting {
+	return []connectionSetting{
+		{"PGHOST", "host", &config.PGHost},
+		{"PGPORT", "port", &config.PGPort},
+		{"PGUSER", "user", &config.PGUser},
+		{"PGPASSWORD", "password", &config.PGPassword},
+		{"PGDATABASE", "dbname", &config.PGDatabase},
+		{"PGSSLMODE", "sslmode", &config.PGSSLMode},
+		{"PGSSLROOTCERT", "sslrootcert", &config.PGSSLRootCert},
+		{"PGSSLCERT", "sslcert", &config.PGSSLCert},
+		{"PGSSLKEY", "sslkey", &config.PGSSLKey},
+		{"PGOPTIONS", "options", &config.PGOptions},
+	}
+}
+
+// Fill the connection settings from a postgres:// or postgresql:// URI as
+// handed out by Railway, Heroku, Render and Supabase
+func applyDatabaseURL(config *Config, databaseURL string) error {
+	u, err := url.Parse(databaseURL)
+	if err != nil {
+		return fmt.Errorf("invalid URL: %v", err)
+	}
+
+	if u.Scheme != "postgres" && u.Scheme != "postgresql" {
+		return fmt.Errorf("unsupported scheme %q, expected postgres or postgresql", u.Scheme)
+	}
+
+	values := make(map[string]string)
+
+	if strings.Contains(u.Host, ",") {
+		return fmt.Errorf("multiple hosts are not supported")
+	}
+	if host := u.Hostname(); host != "" {
+		values["host"] = host
+	}
+	if port := u.Port(); port != "" {
+		values["port"] = port
+	}
+	if u.User != nil {
+		values["user"] = u.User.Username()
+		if password, ok := u.User.Password(); ok {
+			values["password"] = password
+		}
+	}
+	if database := strings.TrimPrefix(u.Path, "/"); database != "" {
+		values["dbname"] = database
+	}
+
+	// Query parameters take precedence over the other parts, as in libpq
+	query, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return fmt.Errorf("invalid query parameters: %v", err)
+	}
+
+	settings := connectionSettings(config)
+	known := make(map[string]bool)
+	for _, setting := range settings {
+		known[setting.urlParam] = true
+	}
+	for param, paramValues := range query {
+		if !known[param] {
+			log.Printf("Warning: Ignoring unsupported DATABASE_URL parameter %q", param)
+			continue
+		}
+		values[param] = paramValues[len(paramValues)-1]
+	}
+
+	for _, setting := range settings {
+		if value, ok := values[setting.urlParam]; ok && value != "" {
+			*setting.field = value
+			config.Sources[setting.env] = "DATABASE_URL"
+		}
+	}
+
+	return nil
+}
+
+// Describe where each connection setting came from, without revealing secrets
+func describeConfigSources(config Config) string {
+	var lines []string
+	for _, setting := range connectionSettings(&config) {
+		source, ok := config.Sources[setting.env]
+		if !ok {
+			continue
+		}
+
+		value := *setting.field
+		if setting.env == "PGPASSWORD" {
+			value = "********"
+		}
+		lines = append(lines, fmt.Sprintf("  %s=%s (from %s)", setting.env, value, source))
+	}
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+const defaultDockerSocket = "/var/run/docker.sock"
+
+// Restarts the PostgreSQL container through the Docker Engine API on a unix socket
+type dockerRestarter struct {
+	socketPath string
+	container  string // name or ID, looked up by label if empty
+	label      string // key=value
+	client     *http.Client
+}
+
+func newDockerRestarter(socketPath, container, label string) *dockerRestarter {
+	if socketPath == "" {
+		socketPath = defaultDockerSocket
+	}
+
+	// The host in request URLs is ignored, every connection goes to the socket
+	transport := &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, "unix", socketPath)
+		},
+	}
+
+	return &dockerRestarter{
+		socketPath: socketPath,
+		container:  container,
+		label:      label,
+		client:     &http.Client{Transport: transport},
+	}
+}
+
+func (d *dockerRestarter) Name() string {
+	return "docker"
+}
+
+func (d *dockerRestarter) Restart(ctx context.Context) error {
+	container, err := d.findContainer(ctx)
+	if err != nil {
+		return err
+	}
+
+	// Give Postgres 30 seconds for a clean shutdown before Docker kills it
+	resp, err := d.request(ctx, http.MethodPost, "/containers/"+url.PathEscape(container)+"/restart?t=30")
+	if err != nil {
+		return fmt.Errorf("failed to restart container %s: %v", container, err)
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusNoContent:
+		return nil
+	case http.StatusNotFound:
+		return fmt.Errorf("container %s not found", container)
+	}
+	return fmt.Errorf("failed to restart container %s: %s", container, dockerError(resp))
+}
+
+// Resolve the container to restart, by label unless a name or ID is configured
+func (d *dockerRestarter) findContainer(ctx context.Context) (string, error) {
+	if d.container != "" {
+		return d.container, nil
+	}
+
+	filters, err := json.Marshal(map[string][]string{"label": {d.label}})
+	if err != nil {
+		return "", fmt.Errorf("failed to encode container filter: %v", err)
+	}
+
+	resp, err := d.request(ctx, http.MethodGet, "/containers/json?filters="+url.QueryEscape(string(filters)))
+	if err != nil {
+		return "", fmt.Errorf("failed to list containers: %v", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to list containers: %s", dockerError(resp))
+	}
+
+	var containers []struct {
+		ID    string   `json:"Id"`
+		Names []string `json:"Names"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&containers); err != nil {
+		return "", fmt.Errorf("failed to decode container list: %v", err)
+	}
+
+	switch len(containers) {
+	case 0:
+		return "", fmt.Errorf("no running container has the label %s", d.label)
+	case 1:
+		return containers[0].ID, nil
+	}
+
+	names := make([]string, len(containers))
+	for i, c := range containers {
+		names[i] = strings.TrimPrefix(strings.Join(c.Names, ","), "/")
+	}
+	return "", fmt.Errorf("the label %s matches %d containers (%s), set EXOQUIC_DOCKER_CONTAINER instead",
+		d.label, len(containers), strings.Join(names, ", "))
+}
+
+func (d *dockerRestarter) request(ctx context.Context, method, path string) (*http.Response, error) {
+	req, err := http.NewRequestWithContext(ctx, method, "http://docker"+path, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("docker engine at %s: %v", d.socketPath, err)
+	}
+	return resp, nil
+}
+
+// The error message of a Docker Engine API response
+func dockerError(resp *http.Response) string {
+	var body struct {
+		Message string `json:"message"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err == nil && body.Message != "" {
+		return body.Message
+	}
+	return resp.Status
+}
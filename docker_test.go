@@ -0,0 +1,144 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeContainer struct {
+	ID     string
+	Name   string
+	Labels map[string]string
+}
+
+// A fake Docker Engine API serving the container list and restart endpoints
+type fakeDockerEngine struct {
+	containers []fakeContainer
+
+	mu        sync.Mutex
+	restarted []string
+}
+
+func (f *fakeDockerEngine) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/containers/json":
+		var filters map[string][]string
+		if err := json.Unmarshal([]byte(r.URL.Query().Get("filters")), &filters); err != nil {
+			http.Error(w, `{"message": "invalid filters"}`, http.StatusBadRequest)
+			return
+		}
+
+		type listed struct {
+			ID    string   `json:"Id"`
+			Names []string `json:"Names"`
+		}
+		matched := []listed{}
+		for _, c := range f.containers {
+			ok := true
+			for _, label := range filters["label"] {
+				key, value, _ := strings.Cut(label, "=")
+				ok = ok && c.Labels[key] == value
+			}
+			if ok {
+				matched = append(matched, listed{ID: c.ID, Names: []string{"/" + c.Name}})
+			}
+		}
+		json.NewEncoder(w).Encode(matched)
+
+	case r.Method == http.MethodPost && strings.HasPrefix(r.URL.Path, "/containers/") && strings.HasSuffix(r.URL.Path, "/restart"):
+		container := strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/containers/"), "/restart")
+		for _, c := range f.containers {
+			if c.ID == container || c.Name == container {
+				f.mu.Lock()
+				f.restarted = append(f.restarted, container)
+				f.mu.Unlock()
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+		}
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"message": "No such container: ` + container + `"}`))
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Serve the fake engine on a unix socket and return the socket path
+func serveFakeDocker(t *testing.T, engine *fakeDockerEngine) string {
+	t.Helper()
+
+	// Socket paths are limited to about 100 bytes, t.TempDir can be longer
+	dir, err := os.MkdirTemp("", "docker")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+
+	socketPath := filepath.Join(dir, "docker.sock")
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	server := httptest.NewUnstartedServer(engine)
+	server.Listener = listener
+	server.Start()
+	t.Cleanup(server.Close)
+	return socketPath
+}
+
+func TestDockerRestarter(t *testing.T) {
+	containers := []fakeContainer{
+		{ID: "a1", Name: "exoquic-postgres", Labels: map[string]string{"app": "postgres", "role": "primary"}},
+		{ID: "b2", Name: "replica-1", Labels: map[string]string{"app": "postgres", "role": "replica"}},
+		{ID: "c3", Name: "replica-2", Labels: map[string]string{"app": "postgres", "role": "replica"}},
+	}
+
+	tests := []struct {
+		name      string
+		container string
+		label     string
+		restarted string
+		err       string
+	}{
+		{name: "by name", container: "exoquic-postgres", restarted: "exoquic-postgres"},
+		{name: "by label", label: "role=primary", restarted: "a1"},
+		{name: "unknown name", container: "missing", err: "container missing not found"},
+		{name: "label matches nothing", label: "role=standby", err: "no running container has the label role=standby"},
+		{name: "label matches several", label: "role=replica", err: "matches 2 containers (replica-1, replica-2)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			engine := &fakeDockerEngine{containers: containers}
+			restarter := newDockerRestarter(serveFakeDocker(t, engine), test.container, test.label)
+
+			err := restarter.Restart(context.Background())
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("Restart() error = %v, want %q", err, test.err)
+				}
+				if len(engine.restarted) > 0 {
+					t.Fatalf("restarted %v, want no restart", engine.restarted)
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("Restart() error = %v", err)
+			}
+			if len(engine.restarted) != 1 || engine.restarted[0] != test.restarted {
+				t.Fatalf("restarted %v, want [%s]", engine.restarted, test.restarted)
+			}
+		})
+	}
+}
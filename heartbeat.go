@@ -0,0 +1,163 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The table the heartbeat command updates, created by the migrations
+const heartbeatTable = "exoquic.heartbeat"
+
+// Prefix of the logical decoding messages emitted with each heartbeat
+const heartbeatMessagePrefix = "exoquic_heartbeat"
+
+// Let the replication user read the heartbeat table, which lives outside the
+// schemas it is granted on
+func grantHeartbeat(db *sql.DB, plan *Plan, caps Capabilities, username string) (string, error) {
+	var result strings.Builder
+
+	var roleExists, tableExists bool
+	err := db.QueryRow(`
+		SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1), to_regclass($2) IS NOT NULL
+	`, username, heartbeatTable).Scan(&roleExists, &tableExists)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if heartbeat table exists: %v", err)
+	}
+
+	grants := []string{
+		fmt.Sprintf("GRANT USAGE ON SCHEMA exoquic TO %s", quoteIdent(username)),
+		fmt.Sprintf("GRANT SELECT ON %s TO %s", heartbeatTable, quoteIdent(username)),
+	}
+	if !roleExists && !caps.CreateRole {
+		plan.manual("Heartbeat", fmt.Sprintf("let %s read %s", username, heartbeatTable), manualInstructions(caps, "", grants...))
+		result.WriteString(fmt.Sprintf("MANUAL: Grant %s SELECT on %s once it exists.\n", username, heartbeatTable))
+		return result.String(), nil
+	}
+
+	// A role or table that doesn't exist yet, during a dry run, has no privileges
+	hasUsage, hasSelect := false, false
+	if roleExists && tableExists {
+		err = db.QueryRow(`
+			SELECT has_schema_privilege($1, 'exoquic', 'USAGE'), has_table_privilege($1, $2, 'SELECT')
+		`, username, heartbeatTable).Scan(&hasUsage, &hasSelect)
+		if err != nil {
+			return "", fmt.Errorf("failed to check heartbeat permissions: %v", err)
+		}
+	}
+
+	if !hasUsage {
+		err = plan.exec(db, Change{
+			Step:   "Heartbeat",
+			Action: "grant",
+			Object: fmt.Sprintf("USAGE on schema exoquic to %s", username),
+			SQL:    grants[0],
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to grant usage on schema exoquic: %v", err)
+		}
+	}
+
+	if !hasSelect {
+		err = plan.exec(db, Change{
+			Step:   "Heartbeat",
+			Action: "grant",
+			Object: fmt.Sprintf("SELECT on %s to %s", heartbeatTable, username),
+			SQL:    grants[1],
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to grant select on %s: %v", heartbeatTable, err)
+		}
+	}
+
+	if hasUsage && hasSelect {
+		result.WriteString(fmt.Sprintf("%s can already read %s.\n", username, heartbeatTable))
+	} else {
+		result.WriteString(fmt.Sprintf("Granted SELECT on %s to %s.\n", heartbeatTable, username))
+	}
+	return result.String(), nil
+}
+
+// Update the heartbeat row, and emit a logical decoding message if asked to
+func beat(db *sql.DB, emitMessage bool) error {
+	_, err := db.Exec(fmt.Sprintf("UPDATE %s SET beat_at = now(), beat_count = beat_count + 1 WHERE id = 1", heartbeatTable))
+	if err != nil {
+		return fmt.Errorf("failed to update %s: %v", heartbeatTable, err)
+	}
+
+	// Non-transactional, so the message is decoded even without a published change
+	if emitMessage {
+		_, err = db.Exec("SELECT pg_logical_emit_message(false, $1, now()::text)", heartbeatMessagePrefix)
+		if err != nil {
+			return fmt.Errorf("failed to emit heartbeat message: %v", err)
+		}
+	}
+	return nil
+}
+
+// Update the heartbeat table periodically until interrupted
+func runHeartbeat(config Config, args []string) {
+	flags := flag.NewFlagSet("heartbeat", flag.ExitOnError)
+	flags.DurationVar(&config.HeartbeatInterval, "interval", config.HeartbeatInterval, "time between heartbeats")
+	flags.BoolVar(&config.HeartbeatMessage, "emit-message", config.HeartbeatMessage, "also emit a logical decoding message with pg_logical_emit_message")
+	flags.Parse(args)
+
+	if err := validateConfig(config); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if config.HeartbeatInterval <= 0 {
+		log.Fatalf("Configuration error: the heartbeat interval must be positive")
+	}
+
+	db, err := connectWithRetry(config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer db.Close()
+
+	var tableExists bool
+	if err := db.QueryRow("SELECT to_regclass($1) IS NOT NULL", heartbeatTable).Scan(&tableExists); err != nil {
+		log.Fatalf("Failed to check if %s exists: %v", heartbeatTable, err)
+	}
+	if !tableExists {
+		log.Fatalf("%s does not exist, run apply first", heartbeatTable)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Printf("Updating %s every %v", heartbeatTable, config.HeartbeatInterval)
+	heartbeatLoop(ctx, db, config.HeartbeatInterval, config.HeartbeatMessage)
+	log.Println("Heartbeat stopped")
+}
+
+// Beat every interval until ctx is done. Failures are logged and retried at the
+// next beat, database/sql reconnects if the server went away.
+func heartbeatLoop(ctx context.Context, db *sql.DB, interval time.Duration, emitMessage bool) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	failing := false
+	for {
+		if err := beat(db, emitMessage); err != nil {
+			log.Printf("Warning: %v", err)
+			failing = true
+		} else if failing {
+			log.Println("Heartbeat recovered")
+			failing = false
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
@@ -2,17 +2,23 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
 	"strings"
+	"syscall"
 	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
 // Configuration from environment variables
@@ -24,27 +30,75 @@ type Config struct {
 	PGPassword string
 	PGDatabase string
 
+	// TLS settings for the PostgreSQL connection
+	PGSSLMode     string
+	PGSSLRootCert string
+	PGSSLCert     string
+	PGSSLKey      string
+
+	// Extra server options such as "-c search_path=app"
+	PGOptions string
+
+	// Where each connection setting came from, keyed by environment variable
+	Sources map[string]string
+
 	// Exoquic configuration
 	ReplicationUser     string
 	ReplicationPassword string
 	PublicationName     string
 	SlotName            string
-	TablesToCapture     []string // Empty means all tables
+	TablesToCapture     []string // Names and patterns, empty means all tables
+	Schemas             []string // Empty means every non-system schema
+	ExcludeSchemas      []string
+	CaptureMode         string // tables, or schema for FOR TABLES IN SCHEMA on PostgreSQL 15+
+	TableSpecs          map[tableName]tableSpec
+
+	// Operations the publication publishes and whether partitions are published as their root table
+	PublishOperations       []string
+	PublishViaPartitionRoot bool
 
 	// Exoquic cloud connection
 	ExoquicAPIKey      string
 	ExoquicCloudURL    string
 	ExoquicEnvironment string // Dev or prod
+
+	// Targets for max_replication_slots and max_wal_senders, see walTuning
+	WALHeadroom         int
+	MaxReplicationSlots int
+	MaxWalSenders       int
+
+	// Heartbeats keep the slot advancing on databases whose captured tables rarely change
+	Heartbeat         bool // add exoquic.heartbeat to a publication that lists its tables
+	HeartbeatInterval time.Duration
+	HeartbeatMessage  bool // also emit a logical decoding message
+
+	// Cap on the WAL a slot may retain, such as 10GB, empty to leave it unchanged
+	MaxSlotWALKeepSize string
+
+	// Settings of the monitor command
+	MonitorInterval  time.Duration
+	AlertRetainedWAL string // size such as 5GB, empty to disable
+	AlertFlushLag    string
+	AlertInactive    time.Duration
+	MetricsAddr      string // empty to not serve metrics
+
+	// How long apply waits for a server restart, zero to not wait at all
+	RestartTimeout time.Duration
+
+	// Opt-in driver that restarts the server instead of waiting for the user
+	RestartDriver   string // docker, systemd, pg_ctl, or empty for none
+	DockerSocket    string
+	DockerContainer string // name or ID
+	DockerLabel     string // key=value, used when no container is set
+	SystemdUnit     string
+	PGData          string // data directory for pg_ctl
+	PGCtl           string // path to pg_ctl
 }
 
-func loadConfig() Config {
+func loadConfig() (Config, error) {
 	// Set defaults and then override with environment variables
 	config := Config{
-		PGHost:              os.Getenv("PGHOST"),
-		PGPort:              os.Getenv("PGPORT"),
-		PGUser:              os.Getenv("PGUSER"),
-		PGPassword:          os.Getenv("PGPASSWORD"),
-		PGDatabase:          os.Getenv("PGDATABASE"),
+		Sources:             make(map[string]string),
 		ReplicationUser:     os.Getenv("EXOQUIC_REPLICATION_USER"),
 		ReplicationPassword: os.Getenv("EXOQUIC_REPLICATION_PASSWORD"),
 		PublicationName:     os.Getenv("EXOQUIC_PUBLICATION_NAME"),
@@ -52,11 +106,41 @@ func loadConfig() Config {
 		ExoquicAPIKey:       os.Getenv("EXOQUIC_API_KEY"),
 		ExoquicCloudURL:     os.Getenv("EXOQUIC_CLOUD_URL"),
 		ExoquicEnvironment:  os.Getenv("EXOQUIC_ENV"),
+		RestartDriver:       os.Getenv("EXOQUIC_RESTART_DRIVER"),
+		DockerSocket:        os.Getenv("EXOQUIC_DOCKER_SOCKET"),
+		DockerContainer:     os.Getenv("EXOQUIC_DOCKER_CONTAINER"),
+		DockerLabel:         os.Getenv("EXOQUIC_DOCKER_LABEL"),
+		SystemdUnit:         os.Getenv("EXOQUIC_SYSTEMD_UNIT"),
+		PGData:              os.Getenv("PGDATA"),
+		PGCtl:               os.Getenv("EXOQUIC_PG_CTL"),
+		MaxSlotWALKeepSize:  os.Getenv("EXOQUIC_MAX_SLOT_WAL_KEEP_SIZE"),
+		AlertRetainedWAL:    os.Getenv("EXOQUIC_ALERT_RETAINED_WAL"),
+		AlertFlushLag:       os.Getenv("EXOQUIC_ALERT_FLUSH_LAG"),
+		MetricsAddr:         os.Getenv("EXOQUIC_METRICS_ADDR"),
+		CaptureMode:         os.Getenv("EXOQUIC_CAPTURE_MODE"),
+	}
+
+	// Start from DATABASE_URL, explicit environment variables override its parts
+	if databaseURL := os.Getenv("DATABASE_URL"); databaseURL != "" {
+		if err := applyDatabaseURL(&config, databaseURL); err != nil {
+			return config, fmt.Errorf("DATABASE_URL: %v", err)
+		}
+	}
+	for _, setting := range connectionSettings(&config) {
+		if value := os.Getenv(setting.env); value != "" {
+			*setting.field = value
+			config.Sources[setting.env] = setting.env
+		}
 	}
 
 	// Set defaults for empty values
 	if config.PGPort == "" {
 		config.PGPort = "5432"
+		config.Sources["PGPORT"] = "default"
+	}
+	if config.PGSSLMode == "" {
+		config.PGSSLMode = "disable"
+		config.Sources["PGSSLMODE"] = "default"
 	}
 	if config.ReplicationUser == "" {
 		config.ReplicationUser = "exoquic_replication"
@@ -67,36 +151,158 @@ func loadConfig() Config {
 	if config.SlotName == "" {
 		config.SlotName = "exoquic_replication_slot"
 	}
+	if config.CaptureMode == "" {
+		config.CaptureMode = "tables"
+	}
 	if config.ExoquicCloudURL == "" {
 		config.ExoquicCloudURL = "https://api.exoquic.com"
 	}
 
+	var err error
+	if config.WALHeadroom, err = envInt("EXOQUIC_WAL_HEADROOM", 4); err != nil {
+		return config, err
+	}
+	if config.MaxReplicationSlots, err = envInt("EXOQUIC_MAX_REPLICATION_SLOTS", 0); err != nil {
+		return config, err
+	}
+	if config.MaxWalSenders, err = envInt("EXOQUIC_MAX_WAL_SENDERS", 0); err != nil {
+		return config, err
+	}
+
+	if config.RestartTimeout, err = envDuration("EXOQUIC_RESTART_TIMEOUT", 30*time.Minute); err != nil {
+		return config, err
+	}
+	if config.MonitorInterval, err = envDuration("EXOQUIC_MONITOR_INTERVAL", 30*time.Second); err != nil {
+		return config, err
+	}
+	if config.AlertInactive, err = envDuration("EXOQUIC_ALERT_INACTIVE", 0); err != nil {
+		return config, err
+	}
+
+	if config.Heartbeat, err = envBool("EXOQUIC_HEARTBEAT", true); err != nil {
+		return config, err
+	}
+	if config.HeartbeatInterval, err = envDuration("EXOQUIC_HEARTBEAT_INTERVAL", time.Minute); err != nil {
+		return config, err
+	}
+	if config.HeartbeatMessage, err = envBool("EXOQUIC_HEARTBEAT_EMIT_MESSAGE", false); err != nil {
+		return config, err
+	}
+
+	if config.TableSpecs, err = parseTableSpecs(os.Getenv("EXOQUIC_TABLE_SPECS")); err != nil {
+		return config, err
+	}
+
+	if config.PublishOperations, err = parsePublishOperations(envList("EXOQUIC_PUBLISH")); err != nil {
+		return config, err
+	}
+	if config.PublishViaPartitionRoot, err = envBool("EXOQUIC_PUBLISH_VIA_PARTITION_ROOT", false); err != nil {
+		return config, err
+	}
+
+	config.Schemas = envList("EXOQUIC_SCHEMAS")
+	config.ExcludeSchemas = envList("EXOQUIC_EXCLUDE_SCHEMAS")
+
 	// Parse tables to capture
-	tablesStr := os.Getenv("TABLES_TO_CAPTURE")
-	if tablesStr != "" {
-		config.TablesToCapture = strings.Split(tablesStr, ",")
-		// Trim whitespace from table names
-		for i, table := range config.TablesToCapture {
-			config.TablesToCapture[i] = strings.TrimSpace(table)
-		}
+	config.TablesToCapture = splitTablePatterns(os.Getenv("TABLES_TO_CAPTURE"))
+
+	return config, nil
+}
+
+// Read a non-negative integer from the environment
+func envInt(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
 	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, value)
+	}
+	return n, nil
+}
 
-	return config
+// Read a non-negative duration such as 10m from the environment
+func envDuration(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration < 0 {
+		return 0, fmt.Errorf("%s must be a duration such as 10m, got %q", name, value)
+	}
+	return duration, nil
+}
+
+// Read a boolean such as true or 0 from the environment
+func envBool(name string, defaultValue bool) (bool, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return false, fmt.Errorf("%s must be true or false, got %q", name, value)
+	}
+	return b, nil
+}
+
+func (c Config) walTuning() walTuning {
+	return walTuning{
+		Headroom:            c.WALHeadroom,
+		MaxReplicationSlots: c.MaxReplicationSlots,
+		MaxWalSenders:       c.MaxWalSenders,
+	}
 }
 
 func validateConfig(config Config) error {
+	if sources := describeConfigSources(config); sources != "" {
+		log.Printf("Connection settings:\n%s", sources)
+	}
+
 	if config.PGHost == "" {
-		return fmt.Errorf("PGHOST environment variable is required")
+		return fmt.Errorf("PGHOST environment variable or a host in DATABASE_URL is required")
 	}
 	if config.PGUser == "" {
-		return fmt.Errorf("PGUSER environment variable is required")
+		return fmt.Errorf("PGUSER environment variable or a user in DATABASE_URL is required")
 	}
 	if config.PGPassword == "" {
-		return fmt.Errorf("PGPASSWORD environment variable is required")
+		return fmt.Errorf("PGPASSWORD environment variable or a password in DATABASE_URL is required")
 	}
 	if config.PGDatabase == "" {
-		return fmt.Errorf("PGDATABASE environment variable is required")
+		return fmt.Errorf("PGDATABASE environment variable or a database in DATABASE_URL is required")
+	}
+	switch config.PGSSLMode {
+	case "disable", "require", "verify-ca", "verify-full":
+	default:
+		return fmt.Errorf("sslmode (from %s) must be one of disable, require, verify-ca or verify-full, got %q", config.Sources["PGSSLMODE"], config.PGSSLMode)
 	}
+	if (config.PGSSLCert == "") != (config.PGSSLKey == "") {
+		return fmt.Errorf("PGSSLCERT and PGSSLKEY must be set together")
+	}
+	for _, table := range config.TablesToCapture {
+		if _, err := parseTablePattern(table); err != nil {
+			return fmt.Errorf("TABLES_TO_CAPTURE: %v", err)
+		}
+	}
+	switch config.CaptureMode {
+	case "tables":
+	case "schema":
+		if len(config.TablesToCapture) > 0 {
+			return fmt.Errorf("EXOQUIC_CAPTURE_MODE=schema publishes whole schemas, select them with EXOQUIC_SCHEMAS instead of TABLES_TO_CAPTURE")
+		}
+		if len(config.TableSpecs) > 0 {
+			return fmt.Errorf("column lists and row filters can't be combined with FOR TABLES IN SCHEMA, use EXOQUIC_CAPTURE_MODE=tables")
+		}
+	default:
+		return fmt.Errorf("EXOQUIC_CAPTURE_MODE must be tables or schema, got %q", config.CaptureMode)
+	}
+	return nil
+}
+
+// Validate the configuration only needed when applying changes
+func validateApplyConfig(config Config) error {
 	if config.ReplicationPassword == "" {
 		return fmt.Errorf("EXOQUIC_REPLICATION_PASSWORD environment variable is required")
 	}
@@ -109,12 +315,59 @@ func validateConfig(config Config) error {
 	return nil
 }
 
+// Build a libpq key/value connection string from the configuration
+func connectionString(config Config) string {
+	params := []struct{ key, value string }{
+		{"host", config.PGHost},
+		{"port", config.PGPort},
+		{"user", config.PGUser},
+		{"password", config.PGPassword},
+		{"dbname", config.PGDatabase},
+		{"sslmode", config.PGSSLMode},
+		{"sslrootcert", config.PGSSLRootCert},
+		{"sslcert", config.PGSSLCert},
+		{"sslkey", config.PGSSLKey},
+		{"options", config.PGOptions},
+	}
+
+	var parts []string
+	for _, param := range params {
+		if param.value == "" {
+			continue
+		}
+		// Values are quoted so that passwords and paths may contain spaces and quotes
+		value := strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(param.value)
+		parts = append(parts, fmt.Sprintf("%s='%s'", param.key, value))
+	}
+	return strings.Join(parts, " ")
+}
+
+// TLS settings in effect for a connection
+type connectionTLS struct {
+	SSLMode string `json:"sslMode"`
+	SSL     bool   `json:"ssl"`
+	Version string `json:"version,omitempty"`
+	Cipher  string `json:"cipher,omitempty"`
+}
+
+// Check whether the connection actually uses TLS, and which protocol and cipher
+func queryConnectionTLS(db *sql.DB, config Config) (connectionTLS, error) {
+	tls := connectionTLS{SSLMode: config.PGSSLMode}
+
+	var version, cipher sql.NullString
+	err := db.QueryRow("SELECT ssl, version, cipher FROM pg_stat_ssl WHERE pid = pg_backend_pid()").Scan(&tls.SSL, &version, &cipher)
+	if err != nil {
+		return tls, fmt.Errorf("failed to check TLS status: %v", err)
+	}
+	tls.Version = version.String
+	tls.Cipher = cipher.String
+
+	return tls, nil
+}
+
 // Connect to PostgreSQL with retry logic
 func connectWithRetry(config Config) (*sql.DB, error) {
-	connStr := fmt.Sprintf(
-		"host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
-		config.PGHost, config.PGPort, config.PGUser, config.PGPassword, config.PGDatabase,
-	)
+	connStr := connectionString(config)
 
 	var db *sql.DB
 	var err error
@@ -141,35 +394,72 @@ func connectWithRetry(config Config) (*sql.DB, error) {
 	return nil, fmt.Errorf("failed to connect after %d attempts: %v", maxRetries, err)
 }
 
-// Check if the user has superuser privileges
-func checkSuperuserPrivileges(db *sql.DB) (bool, error) {
-	var isSuperuser bool
-	err := db.QueryRow("SELECT usesuper FROM pg_user WHERE usename = current_user").Scan(&isSuperuser)
-	if err != nil {
-		return false, fmt.Errorf("failed to check superuser privileges: %v", err)
-	}
-	return isSuperuser, nil
-}
-
 // Configure WAL settings for logical replication
-func configureWAL(db *sql.DB) (string, error) {
+func configureWAL(db *sql.DB, plan *Plan, caps Capabilities, slotName string, tuning walTuning) (string, error) {
 	var result strings.Builder
 	var restartRequired bool
 
-	// Check and set wal_level
-	var walLevel string
-	err := db.QueryRow("SHOW wal_level").Scan(&walLevel)
+	// Without ALTER SYSTEM, or on a managed provider that ignores it, the changes
+	// are collected into instructions for doing them by hand
+	var manualChanges []settingChange
+	alterSystem := func(name string, change Change) error {
+		if caps.AlterSystem && !caps.Provider.Managed() {
+			return plan.exec(db, change)
+		}
+		manualChanges = append(manualChanges, settingChange{Name: name, From: change.From, To: change.To, SQL: change.SQL})
+		return errManualStep
+	}
+
+	settings, err := querySettings(db, walSettingNames)
 	if err != nil {
-		return "", fmt.Errorf("failed to check wal_level: %v", err)
+		return "", fmt.Errorf("failed to check WAL settings: %v", err)
 	}
 
-	if walLevel != "logical" {
-		_, err = db.Exec("ALTER SYSTEM SET wal_level = 'logical'")
-		if err != nil {
+	// A change from an earlier run that is still waiting for a restart
+	for _, name := range walSettingNames {
+		if settings[name].PendingRestart {
+			result.WriteString(fmt.Sprintf("INFO: A change to %s is already waiting for a server restart.\n", name))
+		}
+	}
+
+	// Check and set wal_level
+	walLevel := settings["wal_level"].Setting
+
+	// Managed providers derive wal_level from their own setting, which only takes effect after a reboot
+	provider := caps.Provider
+	logicalPending := false
+	if provider.LogicalSetting != "" {
+		if provider.logicalEnabled() {
+			result.WriteString(fmt.Sprintf("INFO: %s is on.\n", provider.LogicalSetting))
+			logicalPending = walLevel != "logical"
+		} else {
+			result.WriteString(fmt.Sprintf("INFO: %s is %s.\n", provider.LogicalSetting, valueOrNone(provider.LogicalValue)))
+		}
+	}
+
+	if logicalPending {
+		plan.manual("WAL Configuration", "reboot to apply "+provider.LogicalSetting, provider.restartInstructions())
+		result.WriteString(fmt.Sprintf("MANUAL: %s is on but wal_level is still '%s', the %s instance must be rebooted.\n",
+			provider.LogicalSetting, walLevel, provider.DisplayName))
+	} else if walLevel != "logical" {
+		err = alterSystem("wal_level", Change{
+			Step:   "WAL Configuration",
+			Action: "alter",
+			Object: "setting wal_level",
+			From:   walLevel,
+			To:     "logical",
+			SQL:    "ALTER SYSTEM SET wal_level = 'logical'",
+			undo:   fmt.Sprintf("ALTER SYSTEM SET wal_level = %s", quoteLiteral(walLevel)),
+		})
+		if err == errManualStep {
+			result.WriteString(fmt.Sprintf("MANUAL: wal_level must be changed from '%s' to 'logical'.\n", walLevel))
+		} else if err != nil {
 			result.WriteString(fmt.Sprintf("ERROR: Failed to set wal_level to logical: %v\n", err))
 		} else {
 			// Reload pg configs so that we can modify the replication slots.
-			db.Exec("SELECT pg_reload_conf()")
+			if !plan.DryRun {
+				db.Exec("SELECT pg_reload_conf()")
+			}
 			result.WriteString(fmt.Sprintf("CHANGED: wal_level from '%s' to 'logical'.\n", walLevel))
 			restartRequired = true
 		}
@@ -177,146 +467,303 @@ func configureWAL(db *sql.DB) (string, error) {
 		result.WriteString("INFO: wal_level is correctly set to logical.\n")
 	}
 
-	// Check and set max_replication_slots
-	var maxReplicationSlots int
-	err = db.QueryRow("SHOW max_replication_slots").Scan(&maxReplicationSlots)
+	targets, err := computeWALTargets(db, slotName, tuning)
+	if err != nil {
+		return "", err
+	}
+	for _, note := range targets.Notes {
+		result.WriteString("WARNING: " + note + ".\n")
+	}
+
+	// Check and set max_replication_slots, never lowering it
+	maxReplicationSlots, err := settings["max_replication_slots"].intValue()
 	if err != nil {
 		return "", fmt.Errorf("failed to check max_replication_slots: %v", err)
 	}
 
-	if maxReplicationSlots < 5 {
-		_, err = db.Exec("ALTER SYSTEM SET max_replication_slots = '5'")
-		if err != nil {
-			result.WriteString(fmt.Sprintf("ERROR: Failed to set max_replication_slots to 5: %v\n", err))
+	if maxReplicationSlots < targets.MaxReplicationSlots {
+		err = alterSystem("max_replication_slots", Change{
+			Step:   "WAL Configuration",
+			Action: "alter",
+			Object: "setting max_replication_slots",
+			From:   fmt.Sprintf("%d", maxReplicationSlots),
+			To:     fmt.Sprintf("%d", targets.MaxReplicationSlots),
+			SQL:    fmt.Sprintf("ALTER SYSTEM SET max_replication_slots = '%d'", targets.MaxReplicationSlots),
+			undo:   fmt.Sprintf("ALTER SYSTEM SET max_replication_slots = '%d'", maxReplicationSlots),
+		})
+		if err == errManualStep {
+			result.WriteString(fmt.Sprintf("MANUAL: max_replication_slots must be raised from %d to %d.\n", maxReplicationSlots, targets.MaxReplicationSlots))
+		} else if err != nil {
+			result.WriteString(fmt.Sprintf("ERROR: Failed to set max_replication_slots to %d: %v\n", targets.MaxReplicationSlots, err))
 		} else {
-			result.WriteString(fmt.Sprintf("CHANGED: max_replication_slots from %d to 5.\n", maxReplicationSlots))
+			result.WriteString(fmt.Sprintf("CHANGED: max_replication_slots from %d to %d.\n", maxReplicationSlots, targets.MaxReplicationSlots))
 			restartRequired = true
 		}
 	} else {
-		result.WriteString(fmt.Sprintf("INFO: max_replication_slots is sufficient: %d.\n", maxReplicationSlots))
+		result.WriteString(fmt.Sprintf("INFO: max_replication_slots is sufficient: %d (target %d).\n", maxReplicationSlots, targets.MaxReplicationSlots))
 	}
 
-	// Check and set max_wal_senders
-	var maxWalSenders int
-	err = db.QueryRow("SHOW max_wal_senders").Scan(&maxWalSenders)
+	// Check and set max_wal_senders, never lowering it
+	maxWalSenders, err := settings["max_wal_senders"].intValue()
 	if err != nil {
 		return "", fmt.Errorf("failed to check max_wal_senders: %v", err)
 	}
 
-	if maxWalSenders < 5 {
-		_, err = db.Exec("ALTER SYSTEM SET max_wal_senders = '5'")
-		if err != nil {
-			result.WriteString(fmt.Sprintf("ERROR: Failed to set max_wal_senders to 5: %v\n", err))
+	if maxWalSenders < targets.MaxWalSenders {
+		err = alterSystem("max_wal_senders", Change{
+			Step:   "WAL Configuration",
+			Action: "alter",
+			Object: "setting max_wal_senders",
+			From:   fmt.Sprintf("%d", maxWalSenders),
+			To:     fmt.Sprintf("%d", targets.MaxWalSenders),
+			SQL:    fmt.Sprintf("ALTER SYSTEM SET max_wal_senders = '%d'", targets.MaxWalSenders),
+			undo:   fmt.Sprintf("ALTER SYSTEM SET max_wal_senders = '%d'", maxWalSenders),
+		})
+		if err == errManualStep {
+			result.WriteString(fmt.Sprintf("MANUAL: max_wal_senders must be raised from %d to %d.\n", maxWalSenders, targets.MaxWalSenders))
+		} else if err != nil {
+			result.WriteString(fmt.Sprintf("ERROR: Failed to set max_wal_senders to %d: %v\n", targets.MaxWalSenders, err))
 		} else {
-			result.WriteString(fmt.Sprintf("CHANGED: max_wal_senders from %d to 5.\n", maxWalSenders))
+			result.WriteString(fmt.Sprintf("CHANGED: max_wal_senders from %d to %d.\n", maxWalSenders, targets.MaxWalSenders))
 			restartRequired = true
 		}
 	} else {
-		result.WriteString(fmt.Sprintf("INFO: max_wal_senders is sufficient: %d.\n", maxWalSenders))
+		result.WriteString(fmt.Sprintf("INFO: max_wal_senders is sufficient: %d (target %d).\n", maxWalSenders, targets.MaxWalSenders))
+	}
+
+	if len(manualChanges) > 0 {
+		plan.manual("WAL Configuration", "change the WAL settings for logical replication", provider.walInstructions(manualChanges))
+		if provider.Managed() {
+			result.WriteString(fmt.Sprintf("\nWARNING: %s doesn't allow ALTER SYSTEM, see the manual steps below.\n", provider.DisplayName))
+		} else {
+			result.WriteString("\nWARNING: The current user can't run ALTER SYSTEM, see the manual steps below.\n")
+		}
 	}
 
 	// Apply changes if any were made
 	if restartRequired {
-		_, err = db.Exec("SELECT pg_reload_conf()")
+		err = plan.exec(db, Change{
+			Step:   "WAL Configuration",
+			Action: "reload",
+			Object: "server configuration",
+			SQL:    "SELECT pg_reload_conf()",
+		})
 		if err != nil {
 			result.WriteString(fmt.Sprintf("ERROR: Failed to reload PostgreSQL configuration: %v\n", err))
 		} else {
 			result.WriteString("\nINFO: PostgreSQL configuration reloaded.\n")
 		}
 
+	}
+
+	// After the reload pg_settings tells which of the changes need a restart
+	if restartRequired && !plan.DryRun {
+		pending, err := pendingRestart(db, walSettingNames)
+		if err != nil {
+			result.WriteString(fmt.Sprintf("ERROR: Failed to check for pending restarts: %v\n", err))
+		} else if len(pending) > 0 {
+			result.WriteString("\nWARNING: The following settings require a server restart to take effect:\n")
+			for _, s := range pending {
+				result.WriteString("  - " + s.describePending() + "\n")
+			}
+			result.WriteString(provider.restartInstructions() + "\n")
+		}
+	} else if restartRequired {
 		result.WriteString("\nWARNING: Some changes require a server restart to take effect.\n")
-		result.WriteString("To restart PostgreSQL, you may need to run:\n")
-		result.WriteString("  - For systemd: sudo systemctl restart postgresql\n")
-		result.WriteString("  - For Docker: docker restart <container_name>\n")
-		result.WriteString("  - For Railway.app: Redeploy the PostgreSQL service\n")
+		result.WriteString(provider.restartInstructions() + "\n")
 	}
 
 	return result.String(), nil
 }
 
 // Create replication user
-func createReplicationUser(db *sql.DB, username, password string) (string, error) {
+func createReplicationUser(db *sql.DB, plan *Plan, caps Capabilities, username, password string, schemas []string) (string, error) {
 	var result strings.Builder
 
 	// Check if user exists
-	var userExists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1)", username).Scan(&userExists)
+	var userExists, canReplicate bool
+	err := db.QueryRow(replicationRoleQuery, username).Scan(&userExists, &canReplicate)
 	if err != nil {
 		return "", fmt.Errorf("failed to check if user exists: %v", err)
 	}
 
+	// RDS gives the REPLICATION right through a role instead of the attribute
+	replicationAttribute := " REPLICATION"
+	if caps.ReplicationGrant != "attribute" {
+		replicationAttribute = ""
+	}
+
 	if userExists {
 		result.WriteString(fmt.Sprintf("Replication user %s already exists.\n", username))
+	} else if !caps.CreateRole {
+		statements := []string{
+			fmt.Sprintf("CREATE ROLE %s WITH LOGIN PASSWORD '<EXOQUIC_REPLICATION_PASSWORD>' REPLICATION", quoteIdent(username)),
+		}
+		for _, schema := range schemas {
+			statements = append(statements, schemaGrantStatements(username, schema)...)
+		}
+		plan.manual("Replication User", "create role "+username, manualInstructions(caps, "replication", statements...))
+		result.WriteString(fmt.Sprintf("MANUAL: The current user can't create roles, create %s by hand.\n", username))
+		return result.String(), nil
 	} else {
 		// Create the user
-		_, err = db.Exec(fmt.Sprintf("CREATE ROLE %s WITH LOGIN PASSWORD '%s' REPLICATION", username, password))
+		err = plan.exec(db, Change{
+			Step:   "Replication User",
+			Action: "create",
+			Object: "role " + username,
+			SQL:    fmt.Sprintf("CREATE ROLE %s WITH LOGIN PASSWORD '********'%s", quoteIdent(username), replicationAttribute),
+
+			statement: fmt.Sprintf("CREATE ROLE %s WITH LOGIN PASSWORD %s%s", quoteIdent(username), quoteLiteral(password), replicationAttribute),
+		})
 		if err != nil {
 			return "", fmt.Errorf("failed to create replication user: %v", err)
 		}
 		result.WriteString(fmt.Sprintf("Created replication user %s.\n", username))
+		canReplicate = caps.ReplicationGrant == "attribute"
+	}
+
+	// Give the REPLICATION right in the way this server allows
+	if !canReplicate {
+		switch caps.ReplicationGrant {
+		case "attribute":
+			err = plan.exec(db, Change{
+				Step:   "Replication User",
+				Action: "alter",
+				Object: fmt.Sprintf("role %s replication", username),
+				From:   "false",
+				To:     "true",
+				SQL:    fmt.Sprintf("ALTER ROLE %s WITH REPLICATION", quoteIdent(username)),
+			})
+		case "rds_replication":
+			err = plan.exec(db, Change{
+				Step:   "Replication User",
+				Action: "grant",
+				Object: fmt.Sprintf("rds_replication to %s", username),
+				SQL:    fmt.Sprintf("GRANT rds_replication TO %s", quoteIdent(username)),
+			})
+		default:
+			plan.manual("Replication User", fmt.Sprintf("give %s the REPLICATION right", username),
+				manualInstructions(caps, "replication", fmt.Sprintf("ALTER ROLE %s WITH REPLICATION", quoteIdent(username))))
+			result.WriteString(fmt.Sprintf("MANUAL: The current user can't give %s the REPLICATION right.\n", username))
+		}
+		if err != nil {
+			return "", fmt.Errorf("failed to give replication right: %v", err)
+		}
 	}
 
-	// Grant permissions
-	_, err = db.Exec(fmt.Sprintf("GRANT USAGE ON SCHEMA public TO %s", username))
-	if err != nil {
-		return "", fmt.Errorf("failed to grant usage permission: %v", err)
+	// A schema the current user has no rights on, such as one owned by the
+	// provider, is left to someone who does instead of failing the step
+	var granted []string
+	for _, schema := range schemas {
+		if err := grantSchema(db, plan, username, schema, userExists); err != nil {
+			plan.manual("Replication User", fmt.Sprintf("grant %s read access to schema %s", username, schema),
+				manualInstructions(caps, "", schemaGrantStatements(username, schema)...))
+			result.WriteString(fmt.Sprintf("MANUAL: Could not grant %s read access to schema %s: %v\n", username, schema, err))
+			continue
+		}
+		granted = append(granted, schema)
 	}
 
-	_, err = db.Exec(fmt.Sprintf("GRANT SELECT ON ALL TABLES IN SCHEMA public TO %s", username))
-	if err != nil {
-		return "", fmt.Errorf("failed to grant select permission: %v", err)
+	if len(granted) > 0 {
+		result.WriteString(fmt.Sprintf("Granted SELECT permissions to %s on all tables in %s.\n", username, describeSchemas(granted)))
 	}
-
-	_, err = db.Exec(fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA public GRANT SELECT ON TABLES TO %s", username))
-	if err != nil {
-		return "", fmt.Errorf("failed to alter default privileges: %v", err)
-	}
-
-	result.WriteString(fmt.Sprintf("Granted SELECT permissions to %s on all tables.\n", username))
 	return result.String(), nil
 }
 
-// Create publication
-func createPublication(db *sql.DB, publicationName string, tables []string) (string, error) {
-	var result strings.Builder
+// The statements that give the replication user read access to a schema
+func schemaGrantStatements(username, schema string) []string {
+	return []string{
+		fmt.Sprintf("GRANT USAGE ON SCHEMA %s TO %s", quoteIdent(schema), quoteIdent(username)),
+		fmt.Sprintf("GRANT SELECT ON ALL TABLES IN SCHEMA %s TO %s", quoteIdent(schema), quoteIdent(username)),
+		fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT SELECT ON TABLES TO %s", quoteIdent(schema), quoteIdent(username)),
+	}
+}
 
-	// Check if publication exists
-	var publicationExists bool
-	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_publication WHERE pubname = $1)", publicationName).Scan(&publicationExists)
+// Grant the replication user read access to a schema, skipping the permissions
+// it already has. A role that doesn't exist yet has none.
+func grantSchema(db *sql.DB, plan *Plan, username, schema string, userExists bool) error {
+	// Checked up front so that plan reports the manual step too
+	var canGrant bool
+	err := db.QueryRow(`
+		SELECT pg_has_role(current_user, nspowner, 'USAGE')
+			OR has_schema_privilege(current_user, oid, 'USAGE WITH GRANT OPTION')
+		FROM pg_namespace WHERE nspname = $1
+	`, schema).Scan(&canGrant)
 	if err != nil {
-		return "", fmt.Errorf("failed to check if publication exists: %v", err)
+		return fmt.Errorf("failed to check privileges on schema %s: %v", schema, err)
+	}
+	if !canGrant {
+		return fmt.Errorf("the current user neither owns schema %s nor may grant USAGE on it", schema)
 	}
 
-	if publicationExists {
-		result.WriteString(fmt.Sprintf("Publication %s already exists.\n", publicationName))
+	hasUsage, missingSelect, hasDefaultPrivileges := false, 0, false
+	if userExists {
+		err := db.QueryRow(`
+			SELECT has_schema_privilege($1, $2, 'USAGE'),
+				(SELECT count(*)
+					FROM pg_class c
+					JOIN pg_namespace n ON n.oid = c.relnamespace
+					WHERE c.relkind IN ('r', 'p', 'v', 'm', 'f')
+						AND n.nspname = $2
+						AND NOT has_table_privilege($1, c.oid, 'SELECT')),
+				EXISTS(
+					SELECT 1
+					FROM pg_default_acl d
+					JOIN pg_namespace n ON n.oid = d.defaclnamespace
+					CROSS JOIN aclexplode(d.defaclacl) a
+					JOIN pg_roles r ON r.oid = a.grantee
+					WHERE n.nspname = $2
+						AND d.defaclobjtype = 'r'
+						AND d.defaclrole = (SELECT oid FROM pg_roles WHERE rolname = current_user)
+						AND r.rolname = $1
+						AND a.privilege_type = 'SELECT')
+		`, username, schema).Scan(&hasUsage, &missingSelect, &hasDefaultPrivileges)
+		if err != nil {
+			return fmt.Errorf("failed to check existing permissions on schema %s: %v", schema, err)
+		}
+	}
 
-		// Drop and recreate the publication
-		_, err = db.Exec(fmt.Sprintf("DROP PUBLICATION %s", publicationName))
+	if !hasUsage {
+		err := plan.exec(db, Change{
+			Step:   "Replication User",
+			Action: "grant",
+			Object: fmt.Sprintf("USAGE on schema %s to %s", schema, username),
+			SQL:    fmt.Sprintf("GRANT USAGE ON SCHEMA %s TO %s", quoteIdent(schema), quoteIdent(username)),
+		})
 		if err != nil {
-			return "", fmt.Errorf("failed to drop existing publication: %v", err)
+			return fmt.Errorf("failed to grant usage permission on schema %s: %v", schema, err)
 		}
-		result.WriteString("Dropped existing publication to recreate it.\n")
 	}
 
-	// Create the publication
-	var createCmd string
-	if len(tables) == 0 {
-		createCmd = fmt.Sprintf("CREATE PUBLICATION %s FOR ALL TABLES", publicationName)
-	} else {
-		createCmd = fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", publicationName, strings.Join(tables, ", "))
+	if !userExists || missingSelect > 0 {
+		err := plan.exec(db, Change{
+			Step:   "Replication User",
+			Action: "grant",
+			Object: fmt.Sprintf("SELECT on all tables in schema %s to %s", schema, username),
+			SQL:    fmt.Sprintf("GRANT SELECT ON ALL TABLES IN SCHEMA %s TO %s", quoteIdent(schema), quoteIdent(username)),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to grant select permission on schema %s: %v", schema, err)
+		}
 	}
 
-	_, err = db.Exec(createCmd)
-	if err != nil {
-		return "", fmt.Errorf("failed to create publication: %v", err)
+	if !hasDefaultPrivileges {
+		err := plan.exec(db, Change{
+			Step:   "Replication User",
+			Action: "grant",
+			Object: fmt.Sprintf("default SELECT on new tables in schema %s to %s", schema, username),
+			SQL:    fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA %s GRANT SELECT ON TABLES TO %s", quoteIdent(schema), quoteIdent(username)),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to alter default privileges in schema %s: %v", schema, err)
+		}
 	}
 
-	result.WriteString(fmt.Sprintf("Created publication %s.\n", publicationName))
-	return result.String(), nil
+	return nil
 }
 
 // Create replication slot
-func createReplicationSlot(db *sql.DB, slotName string) (string, error) {
+func createReplicationSlot(db *sql.DB, plan *Plan, caps Capabilities, slotName string) (string, error) {
 	var result strings.Builder
 
 	// Check if slot exists
@@ -328,9 +775,40 @@ func createReplicationSlot(db *sql.DB, slotName string) (string, error) {
 
 	if slotExists {
 		result.WriteString(fmt.Sprintf("Replication slot %s already exists.\n", slotName))
+
+		retention, ok, err := querySlotRetention(db, slotName)
+		if err != nil {
+			return "", err
+		}
+		if ok {
+			result.WriteString(fmt.Sprintf("INFO: WAL status %s, retaining %s.\n", retention.WALStatus, formatBytes(retention.RetainedBytes)))
+			if warning := retention.warning(); warning != "" {
+				result.WriteString("WARNING: " + warning + ".\n")
+			}
+		}
+	} else if !caps.CreateSlot {
+		plan.manual("Replication Slot", "create replication slot "+slotName, manualInstructions(caps, "replication",
+			fmt.Sprintf("SELECT pg_create_logical_replication_slot(%s, 'pgoutput')", quoteLiteral(slotName))))
+		result.WriteString(fmt.Sprintf("MANUAL: The current user can't create replication slots, create %s by hand.\n", slotName))
 	} else {
+		// Logical slots need wal_level logical, until a restart applies it apply
+		// creates the slot after waiting for the restart
+		var walLevel string
+		if err := db.QueryRow("SHOW wal_level").Scan(&walLevel); err != nil {
+			return "", fmt.Errorf("failed to check wal_level: %v", err)
+		}
+		if walLevel != "logical" && !plan.DryRun {
+			result.WriteString(fmt.Sprintf("INFO: wal_level is still '%s', replication slot %s is created after the server restart.\n", walLevel, slotName))
+			return result.String(), nil
+		}
+
 		// Create the slot
-		_, err = db.Exec(fmt.Sprintf("SELECT pg_create_logical_replication_slot('%s', 'pgoutput')", slotName))
+		err = plan.exec(db, Change{
+			Step:   "Replication Slot",
+			Action: "create",
+			Object: fmt.Sprintf("logical replication slot %s using pgoutput", slotName),
+			SQL:    fmt.Sprintf("SELECT pg_create_logical_replication_slot(%s, 'pgoutput')", quoteLiteral(slotName)),
+		})
 		if err != nil {
 			return "", fmt.Errorf("failed to create replication slot: %v", err)
 		}
@@ -341,46 +819,89 @@ func createReplicationSlot(db *sql.DB, slotName string) (string, error) {
 }
 
 // Set REPLICA IDENTITY FULL for tables without primary keys
-func setReplicaIdentityFull(db *sql.DB) (string, error) {
+func setReplicaIdentityFull(db *sql.DB, plan *Plan, caps Capabilities, schemas []string) (string, error) {
 	var result strings.Builder
 
 	rows, err := db.Query(`
-		SELECT n.nspname, c.relname
+		SELECT n.nspname, c.relname, c.relreplident, pg_has_role(c.relowner, 'USAGE'),
+			COALESCE((
+				SELECT ic.relname
+				FROM pg_index i
+				JOIN pg_class ic ON ic.oid = i.indexrelid
+				WHERE i.indrelid = c.oid AND i.indisreplident
+			), '')
 		FROM pg_class c
 		JOIN pg_namespace n ON n.oid = c.relnamespace
 		WHERE c.relkind = 'r' 
-			AND n.nspname = 'public'
+			AND n.nspname = ANY($1)
 			AND NOT EXISTS (
 				SELECT 1 FROM pg_constraint
 				WHERE conrelid = c.oid AND contype = 'p'
 			)
-	`)
+	`, pq.Array(schemas))
 	if err != nil {
 		return "", fmt.Errorf("failed to query tables without primary keys: %v", err)
 	}
 	defer rows.Close()
 
-	tablesModified := false
+	// Collect the tables first so that the statements don't run while the result set is open
+	type candidate struct {
+		table                          tableName
+		replicaIdentity, identityIndex string
+		owned                          bool
+	}
+	var candidates []candidate
 	for rows.Next() {
-		var schemaName, tableName string
-		if err := rows.Scan(&schemaName, &tableName); err != nil {
+		var c candidate
+		if err := rows.Scan(&c.table.Schema, &c.table.Name, &c.replicaIdentity, &c.owned, &c.identityIndex); err != nil {
 			return "", fmt.Errorf("failed to scan row: %v", err)
 		}
+		candidates = append(candidates, c)
+	}
 
-		_, err := db.Exec(fmt.Sprintf("ALTER TABLE %s.%s REPLICA IDENTITY FULL", schemaName, tableName))
+	if err := rows.Err(); err != nil {
+		return result.String(), fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	tablesModified := false
+	var manualStatements []string
+	for _, c := range candidates {
+		if c.replicaIdentity == "f" {
+			continue
+		}
+
+		// Only the owner of a table can change its replica identity
+		if !c.owned && !caps.Superuser {
+			manualStatements = append(manualStatements, fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL", c.table.quoted()))
+			result.WriteString(fmt.Sprintf("MANUAL: Set REPLICA IDENTITY FULL for %s, the current user doesn't own it\n", c.table))
+			continue
+		}
+
+		undo := fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY %s", c.table.quoted(), strings.ToUpper(replicaIdentityName(c.replicaIdentity)))
+		if c.replicaIdentity == "i" {
+			undo = fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY USING INDEX %s", c.table.quoted(), quoteIdent(c.identityIndex))
+		}
+
+		err := plan.exec(db, Change{
+			Step:   "Replica Identity",
+			Action: "alter",
+			Object: fmt.Sprintf("table %s replica identity", c.table),
+			From:   replicaIdentityName(c.replicaIdentity),
+			To:     "full",
+			SQL:    fmt.Sprintf("ALTER TABLE %s REPLICA IDENTITY FULL", c.table.quoted()),
+			undo:   undo,
+		})
 		if err != nil {
-			result.WriteString(fmt.Sprintf("Failed to set REPLICA IDENTITY FULL for %s.%s: %v\n", schemaName, tableName, err))
+			result.WriteString(fmt.Sprintf("Failed to set REPLICA IDENTITY FULL for %s: %v\n", c.table, err))
 		} else {
-			result.WriteString(fmt.Sprintf("Set REPLICA IDENTITY FULL for %s.%s\n", schemaName, tableName))
+			result.WriteString(fmt.Sprintf("Set REPLICA IDENTITY FULL for %s\n", c.table))
 			tablesModified = true
 		}
 	}
 
-	if err := rows.Err(); err != nil {
-		return result.String(), fmt.Errorf("error iterating over rows: %v", err)
-	}
-
-	if !tablesModified {
+	if len(manualStatements) > 0 {
+		plan.manual("Replica Identity", "set REPLICA IDENTITY FULL on tables owned by other roles", manualInstructions(caps, "owner", manualStatements...))
+	} else if !tablesModified {
 		result.WriteString("No tables required REPLICA IDENTITY FULL setting.\n")
 	}
 
@@ -388,7 +909,7 @@ func setReplicaIdentityFull(db *sql.DB) (string, error) {
 }
 
 // Generate connection info
-func generateConnectionInfo(db *sql.DB, config Config) (string, error) {
+func generateConnectionInfo(db *sql.DB, config Config, tls connectionTLS, options publicationOptions) (string, error) {
 	var listenAddresses, port string
 
 	err := db.QueryRow("SHOW listen_addresses").Scan(&listenAddresses)
@@ -406,6 +927,11 @@ func generateConnectionInfo(db *sql.DB, config Config) (string, error) {
 		listenAddresses = config.PGHost
 	}
 
+	tlsStatus := "not used"
+	if tls.SSL {
+		tlsStatus = fmt.Sprintf("%s (%s)", tls.Version, tls.Cipher)
+	}
+
 	connectionInfo := fmt.Sprintf(`
 Exoquic Connection Information:
 ===========================
@@ -415,16 +941,19 @@ Database: %s
 Username: %s
 Replication Slot: %s
 Publication: %s
+Publication Options: %s
+SSL Mode: %s
+TLS: %s
 
 Success!
 Exoquic is now connected to your database!
-`, listenAddresses, port, config.PGDatabase, config.ReplicationUser, config.SlotName, config.PublicationName)
+`, listenAddresses, port, config.PGDatabase, config.ReplicationUser, config.SlotName, config.PublicationName, options, tls.SSLMode, tlsStatus)
 
 	return connectionInfo, nil
 }
 
 // Check tables that need primary keys
-func checkTablePrimaryKeys(db *sql.DB) (string, error) {
+func checkTablePrimaryKeys(db *sql.DB, schemas []string) (string, error) {
 	var result strings.Builder
 
 	result.WriteString("\nTables without primary keys:\n")
@@ -435,12 +964,12 @@ func checkTablePrimaryKeys(db *sql.DB) (string, error) {
 		FROM pg_class c
 		JOIN pg_namespace n ON n.oid = c.relnamespace
 		WHERE c.relkind = 'r'
-			AND n.nspname = 'public'
+			AND n.nspname = ANY($1)
 			AND NOT EXISTS (
 				SELECT 1 FROM pg_constraint
 				WHERE conrelid = c.oid AND contype = 'p'
 			)
-	`)
+	`, pq.Array(schemas))
 	if err != nil {
 		return "", fmt.Errorf("failed to query tables without primary keys: %v", err)
 	}
@@ -473,22 +1002,24 @@ func checkTablePrimaryKeys(db *sql.DB) (string, error) {
 }
 
 // Register with Exoquic cloud (if API key is provided)
-func registerWithExoquic(config Config, connectionInfo string) (string, error) {
+func registerWithExoquic(config Config, connectionInfo string, tls connectionTLS, options publicationOptions) (string, error) {
 	if config.ExoquicAPIKey == "" {
 		return "Skipping Exoquic cloud registration (no API key provided).\n", nil
 	}
 
 	// Prepare connection details to send to the API
 	type ConnectionDetails struct {
-		Host            string `json:"host"`
-		Port            string `json:"port"`
-		Database        string `json:"database"`
-		Username        string `json:"username"`
-		Password        string `json:"password"`
-		ReplicationSlot string `json:"replicationSlot"`
-		Publication     string `json:"publication"`
-		ApiKey          string `json:"apiKey"`
-		Environment     string `json:"environment"`
+		Host            string             `json:"host"`
+		Port            string             `json:"port"`
+		Database        string             `json:"database"`
+		Username        string             `json:"username"`
+		Password        string             `json:"password"`
+		ReplicationSlot string             `json:"replicationSlot"`
+		Publication     string             `json:"publication"`
+		Options         publicationOptions `json:"publicationOptions"`
+		TLS             connectionTLS      `json:"tls"`
+		ApiKey          string             `json:"apiKey"`
+		Environment     string             `json:"environment"`
 	}
 
 	connDetails := ConnectionDetails{
@@ -499,6 +1030,8 @@ func registerWithExoquic(config Config, connectionInfo string) (string, error) {
 		Password:        config.ReplicationPassword,
 		ReplicationSlot: config.SlotName,
 		Publication:     config.PublicationName,
+		Options:         options,
+		TLS:             tls,
 		ApiKey:          config.ExoquicAPIKey,
 		Environment:     config.ExoquicEnvironment,
 	}
@@ -535,48 +1068,86 @@ func registerWithExoquic(config Config, connectionInfo string) (string, error) {
 }
 
 // Create Exoquic schema and functions
-func createExoquicSchema(db *sql.DB) error {
+func createExoquicSchema(db *sql.DB, plan *Plan, caps Capabilities) (string, error) {
 	// Check if schema exists
 	var schemaExists bool
 	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = 'exoquic')").Scan(&schemaExists)
 	if err != nil {
-		return fmt.Errorf("failed to check if schema exists: %v", err)
+		return "", fmt.Errorf("failed to check if schema exists: %v", err)
+	}
+
+	if !schemaExists && !caps.CreateOnDatabase {
+		plan.manual("Exoquic Schema", "create schema exoquic", manualInstructions(caps, "",
+			"CREATE SCHEMA exoquic AUTHORIZATION "+quoteIdent(caps.CurrentUser)))
+		return "", fmt.Errorf("the current user has no CREATE privilege on the database")
 	}
 
 	if !schemaExists {
-		_, err = db.Exec("CREATE SCHEMA exoquic")
+		err = plan.exec(db, Change{
+			Step:   "Exoquic Schema",
+			Action: "create",
+			Object: "schema exoquic",
+			SQL:    "CREATE SCHEMA exoquic",
+		})
 		if err != nil {
-			return fmt.Errorf("failed to create exoquic schema: %v", err)
+			return "", fmt.Errorf("failed to create exoquic schema: %v", err)
 		}
 	}
 
-	// Create exoquic.status view
-	_, err = db.Exec(`
-		CREATE OR REPLACE VIEW exoquic.status AS
-		SELECT 
-			current_database() AS database_name,
-			(SELECT count(*) FROM pg_publication) AS publication_count,
-			(SELECT count(*) FROM pg_replication_slots) AS replication_slot_count,
-			(SELECT count(*) FROM pg_stat_replication) AS active_replication_count;
-	`)
+	// The helper objects are created by the versioned migrations
+	return migrateExoquicSchema(db, plan)
+}
+
+// Record a successful apply in exoquic.config_history
+func recordConfigurationRun(db *sql.DB, plan *Plan) error {
+	_, err := db.Exec("INSERT INTO exoquic.config_history (change_count) VALUES ($1)", len(plan.Changes))
 	if err != nil {
-		return fmt.Errorf("failed to create status view: %v", err)
+		return fmt.Errorf("failed to record configuration run: %v", err)
 	}
-
 	return nil
 }
 
 func main() {
 	log.Println("Starting Exoquic PostgreSQL Configurator for Railway.app")
 
-	// Load configuration from environment variables
-	config := loadConfig()
+	// The command defaults to apply so that existing deployments keep working
+	command := "apply"
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		command, args = args[0], args[1:]
+	}
 
-	// Validate configuration
-	if err := validateConfig(config); err != nil {
+	// Load configuration from environment variables
+	config, err := loadConfig()
+	if err != nil {
 		log.Fatalf("Configuration error: %v", err)
 	}
 
+	switch command {
+	case "plan":
+		runPlan(config, args)
+	case "apply":
+		runApply(config, args)
+	case "status":
+		runStatus(config, args)
+	case "verify":
+		runVerify(config, args)
+	case "monitor":
+		runMonitor(config, args)
+	case "heartbeat":
+		runHeartbeat(config, args)
+	case "teardown":
+		runTeardown(config, args)
+	case "help", "-h", "--help":
+		printUsage()
+	default:
+		printUsage()
+		os.Exit(2)
+	}
+}
+
+// Connect to PostgreSQL and make sure the current user can modify the server
+func openAdminConnection(config Config) (*sql.DB, Capabilities) {
 	// Connect to PostgreSQL with retry
 	db, err := connectWithRetry(config)
 	if err != nil {
@@ -585,25 +1156,41 @@ func main() {
 
 	db.SetConnMaxLifetime(time.Minute * 3)
 
-	// Check superuser privileges
-	isSuperuser, err := checkSuperuserPrivileges(db)
+	// Check which steps the current user is allowed to run, the rest become manual steps
+	caps, err := probeCapabilities(db)
 	if err != nil {
 		log.Fatalf("Error checking privileges: %v", err)
 	}
-
-	if !isSuperuser {
-		log.Println("ERROR: Current user does not have superuser privileges.")
-		os.Exit(1)
+	log.Printf("Privileges of %s: %s", caps.CurrentUser, caps)
+	if caps.Provider.Managed() {
+		log.Printf("Detected %s (%s)", caps.Provider.DisplayName, caps.Provider.Evidence)
 	}
 
-	var output strings.Builder
-	output.WriteString("Exoquic PostgreSQL Configuration Report\n")
-	output.WriteString("=====================================\n\n")
+	return db, caps
+}
+
+// Run every configuration step, recording the changes in the plan. Returns
+// whether any step failed.
+func configureDatabase(db *sql.DB, config Config, caps Capabilities, plan *Plan, output *strings.Builder) bool {
+	// Every step that looks at tables works on the same schemas
+	schemas, providerSchemas, err := resolveSchemas(db, config)
+	if err != nil {
+		log.Fatalf("Error resolving schemas: %v", err)
+	}
+	output.WriteString(fmt.Sprintf("Capturing %s.\n", describeSchemas(schemas)))
+	if len(providerSchemas) > 0 {
+		// They count as excluded, so that the publication doesn't use FOR ALL TABLES
+		config.ExcludeSchemas = append(config.ExcludeSchemas, providerSchemas...)
+		output.WriteString(fmt.Sprintf("INFO: Leaving out the provider %s, list them in EXOQUIC_SCHEMAS to capture them.\n",
+			describeSchemas(providerSchemas)))
+	}
+	output.WriteString("\n")
 
 	// Configure WAL settings
-	walConfig, err := configureWAL(db)
+	walConfig, err := configureWAL(db, plan, caps, config.SlotName, config.walTuning())
 	if err != nil {
 		log.Printf("Warning: Error configuring WAL settings: %v", err)
+		plan.fail("WAL Configuration", err)
 	} else {
 		output.WriteString("WAL Configuration:\n")
 		output.WriteString("------------------\n")
@@ -611,18 +1198,43 @@ func main() {
 		output.WriteString("\n")
 	}
 
+	// Cap the WAL retained by the replication slot
+	retentionConfig, err := configureWALRetention(db, plan, caps, config.MaxSlotWALKeepSize)
+	if err != nil {
+		log.Printf("Warning: Error configuring WAL retention: %v", err)
+		plan.fail("WAL Retention", err)
+	} else {
+		output.WriteString("WAL Retention:\n")
+		output.WriteString("--------------\n")
+		output.WriteString(retentionConfig)
+		output.WriteString("\n")
+	}
+
 	// Create Exoquic schema and functions
-	err = createExoquicSchema(db)
+	schemaResult, err := createExoquicSchema(db, plan, caps)
 	if err != nil {
 		log.Printf("Warning: Error creating Exoquic schema: %v", err)
+		plan.fail("Exoquic Schema", err)
 	} else {
-		output.WriteString("Created Exoquic schema and helper objects.\n\n")
+		output.WriteString("Exoquic Schema:\n")
+		output.WriteString("--------------\n")
+		output.WriteString(schemaResult)
+
+		settingsResult, err := recordExoquicSettings(db, plan, config)
+		if err != nil {
+			log.Printf("Warning: Error recording Exoquic settings: %v", err)
+			plan.fail("Exoquic Schema", err)
+		} else {
+			output.WriteString(settingsResult)
+		}
+		output.WriteString("\n")
 	}
 
 	// Create replication user
-	userResult, err := createReplicationUser(db, config.ReplicationUser, config.ReplicationPassword)
+	userResult, err := createReplicationUser(db, plan, caps, config.ReplicationUser, config.ReplicationPassword, schemas)
 	if err != nil {
 		log.Printf("Warning: Error creating replication user: %v", err)
+		plan.fail("Replication User", err)
 	} else {
 		output.WriteString("Replication User:\n")
 		output.WriteString("----------------\n")
@@ -630,10 +1242,23 @@ func main() {
 		output.WriteString("\n")
 	}
 
+	// Let the replication user read the heartbeat table
+	heartbeatResult, err := grantHeartbeat(db, plan, caps, config.ReplicationUser)
+	if err != nil {
+		log.Printf("Warning: Error granting heartbeat permissions: %v", err)
+		plan.fail("Heartbeat", err)
+	} else {
+		output.WriteString("Heartbeat:\n")
+		output.WriteString("---------\n")
+		output.WriteString(heartbeatResult)
+		output.WriteString("\n")
+	}
+
 	// Create publication
-	pubResult, err := createPublication(db, config.PublicationName, config.TablesToCapture)
+	pubResult, err := createPublication(db, plan, caps, config, schemas)
 	if err != nil {
 		log.Printf("Warning: Error creating publication: %v", err)
+		plan.fail("Publication", err)
 	} else {
 		output.WriteString("Publication:\n")
 		output.WriteString("-----------\n")
@@ -642,9 +1267,10 @@ func main() {
 	}
 
 	// Create replication slot
-	slotResult, err := createReplicationSlot(db, config.SlotName)
+	slotResult, err := createReplicationSlot(db, plan, caps, config.SlotName)
 	if err != nil {
 		log.Printf("Warning: Error creating replication slot: %v", err)
+		plan.fail("Replication Slot", err)
 	} else {
 		output.WriteString("Replication Slot:\n")
 		output.WriteString("----------------\n")
@@ -653,9 +1279,10 @@ func main() {
 	}
 
 	// Set REPLICA IDENTITY FULL for tables without primary keys
-	replicaResult, err := setReplicaIdentityFull(db)
+	replicaResult, err := setReplicaIdentityFull(db, plan, caps, schemas)
 	if err != nil {
 		log.Printf("Warning: Error setting REPLICA IDENTITY: %v", err)
+		plan.fail("Replica Identity", err)
 	} else {
 		output.WriteString("Replica Identity:\n")
 		output.WriteString("----------------\n")
@@ -664,53 +1291,152 @@ func main() {
 	}
 
 	// Check tables that need primary keys
-	tableCheck, err := checkTablePrimaryKeys(db)
+	tableCheck, err := checkTablePrimaryKeys(db, schemas)
 	if err != nil {
 		log.Printf("Warning: Error checking table primary keys: %v", err)
+		plan.fail("Primary Keys", err)
 	} else {
 		output.WriteString(tableCheck)
 		output.WriteString("\n")
 	}
 
-	// Close the connection here
-	db.Close()
+	// Remember the original values so that teardown can restore them
+	if !plan.DryRun {
+		if err := recordPreviousState(db, plan); err != nil {
+			log.Printf("Warning: Error recording previous state: %v", err)
+			plan.fail("Previous State", err)
+		}
+	}
 
-	// TODO: Repeatedly reconnect and check whether the WAL settings have changed every 3 seconds.
-	// Add replication slot if it has.
-	fmt.Println("Modified wal_level, please restart the postgres server to continue.")
-	for {
-		db, err = connectWithRetry(config)
+	return len(plan.Errors) > 0
+}
+
+// Configure the database for Exoquic and register it with Exoquic cloud
+func runApply(config Config, args []string) {
+	flags := flag.NewFlagSet("apply", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "only show the changes apply would make, same as the plan command")
+	format := flags.String("output", "text", "dry-run output format: text or json")
+	flags.DurationVar(&config.RestartTimeout, "timeout", config.RestartTimeout, "how long to wait for a server restart, 0 to not wait")
+	flags.StringVar(&config.RestartDriver, "restart", config.RestartDriver, "restart the server when needed: docker, systemd, pg_ctl or none")
+	flags.Parse(args)
+
+	if *dryRun {
+		runPlan(config, []string{"-output", *format})
+		return
+	}
+
+	// Validate configuration
+	if err := validateConfig(config); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if err := validateApplyConfig(config); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	restarter, err := newRestarter(config)
+	if err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if restarter != nil && config.RestartTimeout == 0 {
+		// The driver shares the deadline of the wait, it could never restart the server
+		log.Fatalf("Configuration error: the %s restart driver needs a restart timeout above 0", restarter.Name())
+	}
+
+	db, caps := openAdminConnection(config)
+
+	var output strings.Builder
+	output.WriteString("Exoquic PostgreSQL Configuration Report\n")
+	output.WriteString("=====================================\n\n")
+
+	plan := &Plan{}
+	failed := configureDatabase(db, config, caps, plan, &output)
+
+	if manual := plan.ManualString(); manual != "" {
+		output.WriteString(manual)
+		output.WriteString("\n")
+	}
 
+	// The replication slot needs wal_level = logical, which may only take effect after a restart
+	applied, status, err := walSettingsApplied(db)
+	if err != nil {
+		log.Printf("Warning: Error checking WAL settings: %v", err)
+	}
+	if !applied {
+		// Only a restart driver can apply settings pending a restart, the other cases need the user
+		pending, err := pendingRestart(db, walSettingNames)
 		if err != nil {
-			fmt.Printf("Could not connect to database, retrying..")
-			time.Sleep(2 * time.Second)
-			continue
+			log.Printf("Warning: Error checking for pending restarts: %v", err)
+		}
+		startedAt, err := postmasterStartTime(db)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		}
+		db.Close()
+		if status != "" {
+			log.Printf("The configuration isn't in effect yet, %s.", status)
 		}
 
-		var walLevel string
-		err := db.QueryRow("SHOW wal_level").Scan(&walLevel)
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		ctx, cancel := context.WithTimeout(ctx, config.RestartTimeout)
+		if restarter != nil && len(pending) > 0 {
+			log.Printf("Restarting the postgres server through %s, waiting up to %v.", restarter.Name(), config.RestartTimeout)
+			if err := restartServer(ctx, restarter, config, startedAt); err != nil {
+				log.Printf("Warning: Error restarting the server, please restart it by hand: %v", err)
+			}
+		} else {
+			log.Printf("Please restart the postgres server to continue, waiting up to %v.", config.RestartTimeout)
+		}
+		db, err = waitForRestart(ctx, config)
+		cancel()
+		stop()
+
 		if err != nil {
-			fmt.Printf("failed to check wal_level: %v\n", err)
-		} else if walLevel != "logical" {
-			fmt.Printf("WAL level is not 'logical', please restart your postgres server for the changes to the WAL level to apply.\n")
-		} else if walLevel == "logical" {
-			slotResult, err := createReplicationSlot(db, config.SlotName)
-			if err != nil {
-				log.Printf("Warning: Error creating replication slot: %v", err)
-			} else {
-				output.WriteString("Replication Slot:\n")
-				output.WriteString("----------------\n")
-				output.WriteString(slotResult)
-				output.WriteString("\n")
-				break
+			fmt.Println("\n" + output.String())
+
+			// A failed step fails again after the restart, so that outcome takes precedence
+			code := exitRestartPending
+			if failed {
+				log.Println("Some configuration steps failed, see the warnings above.")
+				code = exitFailed
 			}
+			switch {
+			case err == errRestartPending:
+				log.Printf("Timed out after %v, the server restart is still pending. Run apply again after restarting.", config.RestartTimeout)
+				os.Exit(code)
+			case errors.Is(err, context.Canceled):
+				log.Println("Interrupted, the server restart is still pending. Run apply again after restarting.")
+				os.Exit(code)
+			}
+			log.Printf("Error waiting for the server restart: %v", err)
+			os.Exit(exitFailed)
 		}
-		db.Close()
-		time.Sleep(3 * time.Second)
+
+		slotResult, err := createReplicationSlot(db, plan, caps, config.SlotName)
+		if err != nil {
+			log.Printf("Error creating replication slot: %v", err)
+			fmt.Println("\n" + output.String())
+			os.Exit(exitFailed)
+		}
+		output.WriteString("Replication Slot:\n")
+		output.WriteString("----------------\n")
+		output.WriteString(slotResult)
+		output.WriteString("\n")
+	}
+	defer db.Close()
+
+	// Check the TLS settings actually used, Exoquic connects the same way
+	tls, err := queryConnectionTLS(db, config)
+	if err != nil {
+		log.Printf("Warning: Error checking connection TLS: %v", err)
+	}
+
+	// Report the effective publication options, Exoquic needs to know which operations it receives
+	options, err := queryPublicationOptions(db, config.PublicationName)
+	if err != nil {
+		log.Printf("Warning: Error checking publication options: %v", err)
 	}
 
 	// Generate connection info
-	connectionInfo, err := generateConnectionInfo(db, config)
+	connectionInfo, err := generateConnectionInfo(db, config, tls, options)
 	if err != nil {
 		log.Printf("Warning: Error generating connection info: %v", err)
 	} else {
@@ -718,9 +1444,10 @@ func main() {
 		output.WriteString("\n")
 	}
 
-	cloudResult, err := registerWithExoquic(config, connectionInfo)
+	cloudResult, err := registerWithExoquic(config, connectionInfo, tls, options)
 	if err != nil {
 		log.Printf("Warning: Error registering with Exoquic cloud: %v", err)
+		failed = true
 	} else {
 		output.WriteString("Exoquic Cloud Registration:\n")
 		output.WriteString("--------------------------\n")
@@ -728,8 +1455,20 @@ func main() {
 		output.WriteString("\n")
 	}
 
+	if failed {
+		fmt.Println("\n" + output.String())
+		log.Println("Configuration failed, see the warnings above. Run apply again after fixing them.")
+		db.Close()
+		os.Exit(exitFailed)
+	}
+
+	// Only a run without failed steps counts as the last successful configuration
+	if err := recordConfigurationRun(db, plan); err != nil {
+		log.Printf("Warning: %v", err)
+	}
+
 	log.Println("Configuration complete!")
 	fmt.Println("\n" + output.String())
-	log.Println("Configuration successful. Service will exit in 5 minutes.")
+	log.Println("Configuration successful.")
 	log.Println("You can safely deploy this Railway service again when needed.")
 }
@@ -11,6 +11,6 @@ EXOQUIC_REPLICATION_USER=exoquic_user \
 EXOQUIC_REPLICATION_PASSWORD=exoquic_password \
 EXOQUIC_API_KEY= \
 EXOQUIC_ENV=dev \
-go run main.go
+go run .
 
 echo "Done. To clean up, run: docker stop exoquic-postgres && docker rm exoquic-postgres"
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Replication health exported on /metrics, sampled by the monitor loop
+type replicationMetrics struct {
+	Slot              slotSample
+	PublicationExists bool
+	PublicationTables int
+	WALSenders        int
+	MaxWALSenders     int
+	WALLevelLogical   bool
+	LastConfigured    sql.NullTime // last successful apply, from exoquic.config_history
+}
+
+// Query everything besides the slot sample
+func queryReplicationMetrics(db *sql.DB, config Config, sample slotSample) (replicationMetrics, error) {
+	metrics := replicationMetrics{Slot: sample}
+
+	err := db.QueryRow(`
+		SELECT
+			EXISTS(SELECT 1 FROM pg_publication WHERE pubname = $1),
+			(SELECT count(*) FROM pg_publication_tables WHERE pubname = $1),
+			(SELECT count(*) FROM pg_stat_replication),
+			current_setting('max_wal_senders')::int,
+			current_setting('wal_level') = 'logical'
+	`, config.PublicationName).Scan(&metrics.PublicationExists, &metrics.PublicationTables, &metrics.WALSenders,
+		&metrics.MaxWALSenders, &metrics.WALLevelLogical)
+	if err != nil {
+		return metrics, fmt.Errorf("failed to query replication metrics: %v", err)
+	}
+
+	// The history table only exists once apply created the exoquic schema
+	var historyExists bool
+	if err := db.QueryRow("SELECT to_regclass('exoquic.config_history') IS NOT NULL").Scan(&historyExists); err != nil {
+		return metrics, fmt.Errorf("failed to check if config history table exists: %v", err)
+	}
+	if historyExists {
+		if err := db.QueryRow("SELECT max(applied_at) FROM exoquic.config_history").Scan(&metrics.LastConfigured); err != nil {
+			return metrics, fmt.Errorf("failed to query config history: %v", err)
+		}
+	}
+
+	return metrics, nil
+}
+
+// Serves the latest metrics and the health endpoints
+type metricsServer struct {
+	slotName        string
+	publicationName string
+	// Ready while the last successful sample is at most this old
+	maxAge time.Duration
+
+	mu          sync.Mutex
+	metrics     replicationMetrics
+	lastSuccess time.Time
+	errorCount  int
+}
+
+func newMetricsServer(config Config) *metricsServer {
+	return &metricsServer{
+		slotName:        config.SlotName,
+		publicationName: config.PublicationName,
+		maxAge:          3 * config.MonitorInterval,
+	}
+}
+
+func (s *metricsServer) update(metrics replicationMetrics) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.metrics = metrics
+	s.lastSuccess = metrics.Slot.Time
+}
+
+func (s *metricsServer) failed() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.errorCount++
+}
+
+func (s *metricsServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		s.writeMetrics(w)
+	})
+
+	// The process is alive as long as it answers
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, "ok")
+	})
+
+	// Ready once the database was sampled recently
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		lastSuccess := s.lastSuccess
+		s.mu.Unlock()
+
+		if lastSuccess.IsZero() {
+			http.Error(w, "no successful sample yet", http.StatusServiceUnavailable)
+			return
+		}
+		if age := time.Since(lastSuccess); age > s.maxAge {
+			http.Error(w, fmt.Sprintf("last successful sample %v ago", age.Truncate(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprintln(w, "ok")
+	})
+	return mux
+}
+
+// Write the metrics in the Prometheus text exposition format
+func (s *metricsServer) writeMetrics(w io.Writer) {
+	s.mu.Lock()
+	m := s.metrics
+	lastSuccess := s.lastSuccess
+	errorCount := s.errorCount
+	s.mu.Unlock()
+
+	slot := fmt.Sprintf(`{slot="%s"}`, escapeLabel(s.slotName))
+	publication := fmt.Sprintf(`{publication="%s"}`, escapeLabel(s.publicationName))
+
+	metric := func(name, kind, help, labels string, value float64) {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s%s %g\n", name, help, name, kind, name, labels, value)
+	}
+
+	metric("exoquic_monitor_errors_total", "counter", "Failed samples of the database.", "", float64(errorCount))
+	if lastSuccess.IsZero() {
+		return
+	}
+	metric("exoquic_monitor_last_success_timestamp_seconds", "gauge", "Time of the last successful sample.", "", float64(lastSuccess.Unix()))
+
+	metric("exoquic_slot_exists", "gauge", "Whether the replication slot exists.", slot, boolValue(m.Slot.Exists))
+	if m.Slot.Exists {
+		metric("exoquic_slot_active", "gauge", "Whether a consumer is connected to the replication slot.", slot, boolValue(m.Slot.Active))
+		metric("exoquic_slot_retained_wal_bytes", "gauge", "WAL retained by the replication slot.", slot, float64(m.Slot.RetainedBytes))
+		metric("exoquic_slot_lag_bytes", "gauge", "WAL not yet confirmed as flushed by the consumer.", slot, float64(m.Slot.FlushLagBytes))
+		if m.Slot.WALStatus != "" {
+			metric("exoquic_slot_wal_at_risk", "gauge", "Whether the replication slot is unreserved or lost.", slot,
+				boolValue(m.Slot.WALStatus == "unreserved" || m.Slot.WALStatus == "lost"))
+		}
+	}
+
+	metric("exoquic_publication_exists", "gauge", "Whether the publication exists.", publication, boolValue(m.PublicationExists))
+	metric("exoquic_publication_tables", "gauge", "Tables published by the publication.", publication, float64(m.PublicationTables))
+	metric("exoquic_wal_senders", "gauge", "WAL senders currently running.", "", float64(m.WALSenders))
+	metric("exoquic_wal_senders_max", "gauge", "The max_wal_senders setting.", "", float64(m.MaxWALSenders))
+	metric("exoquic_wal_level_logical", "gauge", "Whether wal_level is logical.", "", boolValue(m.WALLevelLogical))
+	if m.LastConfigured.Valid {
+		metric("exoquic_last_configured_timestamp_seconds", "gauge", "Time of the last successful apply.", "", float64(m.LastConfigured.Time.Unix()))
+	}
+}
+
+// Serve the metrics until ctx is done
+func serveMetrics(ctx context.Context, addr string, server *metricsServer) {
+	httpServer := &http.Server{Addr: addr, Handler: server.handler(), ReadHeaderTimeout: 10 * time.Second}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		httpServer.Shutdown(shutdownCtx)
+	}()
+
+	log.Printf("Serving metrics on %s", addr)
+	if err := httpServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Metrics server failed: %v", err)
+	}
+}
+
+func boolValue(b bool) float64 {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+func escapeLabel(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
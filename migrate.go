@@ -0,0 +1,145 @@
+package main
+
+import (
+	"database/sql"
+	"embed"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Migrations of the exoquic schema, named <version>_<name>.sql. Never change a
+// released migration, add a new one instead.
+//
+//go:embed migrations/*.sql
+var migrationFiles embed.FS
+
+type migration struct {
+	Version int
+	Name    string
+	SQL     string
+}
+
+// Load the embedded migrations ordered by version
+func loadMigrations() ([]migration, error) {
+	entries, err := migrationFiles.ReadDir("migrations")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read migrations: %v", err)
+	}
+
+	var migrations []migration
+	seen := make(map[int]string)
+	for _, entry := range entries {
+		file := entry.Name()
+		prefix, name, ok := strings.Cut(strings.TrimSuffix(file, ".sql"), "_")
+		version, err := strconv.Atoi(prefix)
+		if !ok || err != nil || version <= 0 {
+			return nil, fmt.Errorf("invalid migration file name %s, expected <version>_<name>.sql", file)
+		}
+		if other, ok := seen[version]; ok {
+			return nil, fmt.Errorf("migrations %s and %s have the same version", other, file)
+		}
+		seen[version] = file
+
+		content, err := migrationFiles.ReadFile(path.Join("migrations", file))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read migration %s: %v", file, err)
+		}
+		migrations = append(migrations, migration{Version: version, Name: name, SQL: string(content)})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].Version < migrations[j].Version
+	})
+	return migrations, nil
+}
+
+// Bring the exoquic schema to the latest version. Each migration runs in its
+// own transaction together with recording it in exoquic.schema_migrations.
+func migrateExoquicSchema(db *sql.DB, plan *Plan) (string, error) {
+	var result strings.Builder
+
+	migrations, err := loadMigrations()
+	if err != nil {
+		return "", err
+	}
+	latest := migrations[len(migrations)-1].Version
+
+	var tableExists bool
+	err = db.QueryRow("SELECT to_regclass('exoquic.schema_migrations') IS NOT NULL").Scan(&tableExists)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if schema migrations table exists: %v", err)
+	}
+
+	if !tableExists {
+		err = plan.exec(db, Change{
+			Step:   "Exoquic Schema",
+			Action: "create",
+			Object: "table exoquic.schema_migrations",
+			SQL: `
+				CREATE TABLE exoquic.schema_migrations (
+					version integer PRIMARY KEY,
+					name text NOT NULL,
+					applied_at timestamptz NOT NULL DEFAULT now()
+				)
+			`,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to create schema migrations table: %v", err)
+		}
+	}
+
+	applied := make(map[int]bool)
+	current := 0
+	if tableExists {
+		rows, err := db.Query("SELECT version FROM exoquic.schema_migrations")
+		if err != nil {
+			return "", fmt.Errorf("failed to query schema migrations: %v", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var version int
+			if err := rows.Scan(&version); err != nil {
+				return "", fmt.Errorf("failed to scan row: %v", err)
+			}
+			applied[version] = true
+			if version > current {
+				current = version
+			}
+		}
+
+		if err := rows.Err(); err != nil {
+			return "", fmt.Errorf("error iterating over rows: %v", err)
+		}
+	}
+
+	// A newer configurer migrated the schema, its objects may not work with this version
+	if current > latest {
+		return "", fmt.Errorf("the exoquic schema is at version %d, newer than version %d of this configurer, refusing to downgrade", current, latest)
+	}
+
+	for _, m := range migrations {
+		if applied[m.Version] {
+			continue
+		}
+
+		err = plan.execTx(db, Change{
+			Step:   "Exoquic Schema",
+			Action: "migrate",
+			Object: fmt.Sprintf("schema exoquic to version %d (%s)", m.Version, m.Name),
+			SQL:    m.SQL,
+		}, fmt.Sprintf("INSERT INTO exoquic.schema_migrations (version, name) VALUES (%d, %s)", m.Version, quoteLiteral(m.Name)))
+		if err != nil {
+			return "", fmt.Errorf("failed to apply migration %d (%s): %v", m.Version, m.Name, err)
+		}
+		result.WriteString(fmt.Sprintf("Migrated schema exoquic to version %d (%s).\n", m.Version, m.Name))
+	}
+
+	if result.Len() == 0 {
+		result.WriteString(fmt.Sprintf("Schema exoquic is at the latest version %d.\n", latest))
+	}
+	return result.String(), nil
+}
@@ -0,0 +1,30 @@
+-- Helper objects created before the schema was versioned. Everything is
+-- idempotent so that existing installations can be brought under migrations.
+
+CREATE OR REPLACE VIEW exoquic.status AS
+SELECT
+	current_database() AS database_name,
+	(SELECT count(*) FROM pg_publication) AS publication_count,
+	(SELECT count(*) FROM pg_replication_slots) AS replication_slot_count,
+	(SELECT count(*) FROM pg_stat_replication) AS active_replication_count;
+
+-- Original values of changed settings and replica identities, used by teardown -restore
+CREATE TABLE IF NOT EXISTS exoquic.previous_state (
+	object text PRIMARY KEY,
+	restore_sql text NOT NULL,
+	recorded_at timestamptz NOT NULL DEFAULT now()
+);
+
+-- One row per successful apply
+CREATE TABLE IF NOT EXISTS exoquic.config_history (
+	id bigserial PRIMARY KEY,
+	applied_at timestamptz NOT NULL DEFAULT now(),
+	applied_by text NOT NULL DEFAULT current_user,
+	change_count integer NOT NULL
+);
+
+-- Names of the Exoquic objects and expected settings, read by the helper views
+CREATE TABLE IF NOT EXISTS exoquic.settings (
+	key text PRIMARY KEY,
+	value text NOT NULL
+);
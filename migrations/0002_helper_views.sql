@@ -0,0 +1,59 @@
+-- Views for diagnosing the setup from psql. Dropped first, CREATE OR REPLACE
+-- can't remove or rename columns of views created by older versions.
+
+DROP VIEW IF EXISTS exoquic.slot_status;
+DO $$
+BEGIN
+	-- wal_status and safe_wal_size only exist since PostgreSQL 13
+	IF current_setting('server_version_num')::int >= 130000 THEN
+		EXECUTE $view$
+			CREATE VIEW exoquic.slot_status AS
+			SELECT s.slot_name, s.plugin, s.active, s.active_pid, s.wal_status, s.safe_wal_size,
+				pg_wal_lsn_diff(pg_current_wal_lsn(), s.restart_lsn)::bigint AS retained_wal_bytes,
+				pg_wal_lsn_diff(pg_current_wal_lsn(), s.confirmed_flush_lsn)::bigint AS lag_bytes,
+				s.restart_lsn, s.confirmed_flush_lsn
+			FROM pg_replication_slots s
+			WHERE s.slot_name = (SELECT value FROM exoquic.settings WHERE key = 'slot_name')
+		$view$;
+	ELSE
+		EXECUTE $view$
+			CREATE VIEW exoquic.slot_status AS
+			SELECT s.slot_name, s.plugin, s.active, s.active_pid, NULL::text AS wal_status, NULL::bigint AS safe_wal_size,
+				pg_wal_lsn_diff(pg_current_wal_lsn(), s.restart_lsn)::bigint AS retained_wal_bytes,
+				pg_wal_lsn_diff(pg_current_wal_lsn(), s.confirmed_flush_lsn)::bigint AS lag_bytes,
+				s.restart_lsn, s.confirmed_flush_lsn
+			FROM pg_replication_slots s
+			WHERE s.slot_name = (SELECT value FROM exoquic.settings WHERE key = 'slot_name')
+		$view$;
+	END IF;
+END
+$$;
+
+DROP VIEW IF EXISTS exoquic.published_tables;
+CREATE VIEW exoquic.published_tables AS
+SELECT pt.schemaname AS schema_name, pt.tablename AS table_name,
+	CASE c.relreplident
+		WHEN 'd' THEN 'default' WHEN 'n' THEN 'nothing' WHEN 'f' THEN 'full' WHEN 'i' THEN 'index'
+	END AS replica_identity,
+	EXISTS (SELECT 1 FROM pg_constraint WHERE conrelid = c.oid AND contype = 'p') AS has_primary_key,
+	pg_total_relation_size(c.oid) AS total_bytes,
+	pg_size_pretty(pg_total_relation_size(c.oid)) AS total_size
+FROM pg_publication_tables pt
+JOIN pg_namespace n ON n.nspname = pt.schemaname
+JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = pt.tablename
+WHERE pt.pubname = (SELECT value FROM exoquic.settings WHERE key = 'publication_name');
+
+DROP VIEW IF EXISTS exoquic.config_check;
+CREATE VIEW exoquic.config_check AS
+WITH expected (name, expected_value, minimum) AS (
+	VALUES
+		('wal_level', 'logical', NULL::int),
+		('max_replication_slots', NULL, (SELECT value::int FROM exoquic.settings WHERE key = 'expected_max_replication_slots')),
+		('max_wal_senders', NULL, (SELECT value::int FROM exoquic.settings WHERE key = 'expected_max_wal_senders'))
+)
+SELECT s.name AS setting, s.setting AS current_value,
+	COALESCE(e.expected_value, '>= ' || e.minimum) AS expected_value,
+	CASE WHEN e.expected_value IS NOT NULL THEN s.setting = e.expected_value ELSE s.setting::int >= e.minimum END AS ok,
+	s.pending_restart, s.context
+FROM expected e
+JOIN pg_settings s ON s.name = e.name;
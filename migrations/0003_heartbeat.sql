@@ -0,0 +1,10 @@
+-- A single row updated by the heartbeat command. The table is published so that
+-- the slot of an idle database still receives changes Exoquic can acknowledge.
+
+CREATE TABLE IF NOT EXISTS exoquic.heartbeat (
+	id integer PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+	beat_at timestamptz NOT NULL DEFAULT now(),
+	beat_count bigint NOT NULL DEFAULT 0
+);
+
+INSERT INTO exoquic.heartbeat (id) VALUES (1) ON CONFLICT (id) DO NOTHING;
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Alert thresholds of the monitor, zero disables a threshold
+type monitorThresholds struct {
+	MaxRetainedBytes int64         // WAL retained by the slot
+	MaxFlushLagBytes int64         // WAL written but not yet confirmed by Exoquic
+	MaxInactive      time.Duration // time without a connected consumer
+}
+
+// The state of the Exoquic slot at one point in time
+type slotSample struct {
+	Time          time.Time
+	Exists        bool
+	Active        bool
+	WALStatus     string // empty before PostgreSQL 13
+	RetainedBytes int64  // current LSN - restart_lsn
+	FlushLagBytes int64  // current LSN - confirmed_flush_lsn
+	// From pg_stat_replication while a consumer is connected
+	SenderState string
+	FlushLag    sql.NullFloat64 // seconds, as reported by the consumer's feedback
+}
+
+// Read the slot and its WAL sender
+func sampleSlot(db *sql.DB, slotName string) (slotSample, error) {
+	sample := slotSample{Time: time.Now()}
+
+	var serverVersion int
+	if err := db.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&serverVersion); err != nil {
+		return sample, fmt.Errorf("failed to check server version: %v", err)
+	}
+
+	// wal_status only exists since PostgreSQL 13
+	walStatus := "''"
+	if serverVersion >= 130000 {
+		walStatus = "COALESCE(s.wal_status, '')"
+	}
+
+	var senderState sql.NullString
+	err := db.QueryRow(`
+		WITH lsn AS (
+			SELECT CASE WHEN pg_is_in_recovery() THEN pg_last_wal_receive_lsn() ELSE pg_current_wal_lsn() END AS current
+		)
+		SELECT s.active, `+walStatus+`,
+			COALESCE(pg_wal_lsn_diff(lsn.current, s.restart_lsn), 0)::bigint,
+			COALESCE(pg_wal_lsn_diff(lsn.current, s.confirmed_flush_lsn), 0)::bigint,
+			r.state, EXTRACT(EPOCH FROM r.flush_lag)::float8
+		FROM pg_replication_slots s
+		CROSS JOIN lsn
+		LEFT JOIN pg_stat_replication r ON r.pid = s.active_pid
+		WHERE s.slot_name = $1
+	`, slotName).Scan(&sample.Active, &sample.WALStatus, &sample.RetainedBytes, &sample.FlushLagBytes, &senderState, &sample.FlushLag)
+	if err == sql.ErrNoRows {
+		return sample, nil
+	}
+	if err != nil {
+		return sample, fmt.Errorf("failed to query replication slot: %v", err)
+	}
+	sample.Exists = true
+	sample.SenderState = senderState.String
+
+	return sample, nil
+}
+
+// Tracks the slot across samples and decides which thresholds fire
+type slotMonitor struct {
+	thresholds monitorThresholds
+
+	started    bool
+	lastActive bool
+	stateSince time.Time       // when the slot became active or inactive, or monitoring started
+	firing     map[string]bool // alerts currently firing, by name
+}
+
+func newSlotMonitor(thresholds monitorThresholds) *slotMonitor {
+	return &slotMonitor{thresholds: thresholds, firing: make(map[string]bool)}
+}
+
+// How long the slot has been in its current active or inactive state. Before
+// the state changed this is the time since monitoring started, a lower bound.
+func (m *slotMonitor) stateDuration(now time.Time) time.Duration {
+	return now.Sub(m.stateSince).Truncate(time.Second)
+}
+
+// Record a sample, returning a log line for every alert that fired or resolved
+func (m *slotMonitor) observe(sample slotSample) []string {
+	if !m.started || sample.Active != m.lastActive {
+		m.started = true
+		m.lastActive = sample.Active
+		m.stateSince = sample.Time
+	}
+
+	conditions := []struct {
+		name    string
+		firing  bool
+		message string
+	}{
+		{"missing", !sample.Exists, "the replication slot does not exist"},
+		{"lost", sample.WALStatus == "lost", "the replication slot was invalidated"},
+		{"unreserved", sample.WALStatus == "unreserved", "the replication slot will be invalidated at the next checkpoint"},
+		{"retained", m.thresholds.MaxRetainedBytes > 0 && sample.RetainedBytes > m.thresholds.MaxRetainedBytes,
+			fmt.Sprintf("retained WAL %s exceeds %s", formatBytes(sample.RetainedBytes), formatBytes(m.thresholds.MaxRetainedBytes))},
+		{"lag", m.thresholds.MaxFlushLagBytes > 0 && sample.FlushLagBytes > m.thresholds.MaxFlushLagBytes,
+			fmt.Sprintf("confirmed flush lag %s exceeds %s", formatBytes(sample.FlushLagBytes), formatBytes(m.thresholds.MaxFlushLagBytes))},
+		{"inactive", m.thresholds.MaxInactive > 0 && sample.Exists && !sample.Active && m.stateDuration(sample.Time) > m.thresholds.MaxInactive,
+			fmt.Sprintf("no consumer connected for %v, more than %v", m.stateDuration(sample.Time), m.thresholds.MaxInactive)},
+	}
+
+	var events []string
+	for _, c := range conditions {
+		if c.firing && !m.firing[c.name] {
+			events = append(events, "ALERT: "+c.message)
+		} else if !c.firing && m.firing[c.name] {
+			events = append(events, fmt.Sprintf("RESOLVED: the %s alert cleared", c.name))
+		}
+		m.firing[c.name] = c.firing
+	}
+	return events
+}
+
+// Describe a sample in one log line
+func (m *slotMonitor) describe(slotName string, sample slotSample) string {
+	if !sample.Exists {
+		return fmt.Sprintf("slot %s: missing", slotName)
+	}
+
+	state := "inactive"
+	if sample.Active {
+		state = "active"
+	}
+	parts := []string{fmt.Sprintf("slot %s: %s for %v", slotName, state, m.stateDuration(sample.Time))}
+	if sample.WALStatus != "" {
+		parts = append(parts, "wal_status "+sample.WALStatus)
+	}
+	parts = append(parts,
+		"retained "+formatBytes(sample.RetainedBytes),
+		"flush lag "+formatBytes(sample.FlushLagBytes))
+	if sample.SenderState != "" {
+		parts = append(parts, "sender "+sample.SenderState)
+	}
+	if sample.FlushLag.Valid {
+		parts = append(parts, fmt.Sprintf("flush lag time %.1fs", sample.FlushLag.Float64))
+	}
+	return strings.Join(parts, ", ")
+}
+
+// Watch the replication slot until interrupted, logging its state and alerts
+func runMonitor(config Config, args []string) {
+	flags := flag.NewFlagSet("monitor", flag.ExitOnError)
+	flags.DurationVar(&config.MonitorInterval, "interval", config.MonitorInterval, "time between samples")
+	maxRetained := flags.String("max-retained", config.AlertRetainedWAL, "alert when the slot retains more WAL, such as 5GB")
+	maxLag := flags.String("max-lag", config.AlertFlushLag, "alert when the confirmed flush lag is larger, such as 1GB")
+	flags.DurationVar(&config.AlertInactive, "max-inactive", config.AlertInactive, "alert when no consumer is connected for longer")
+	flags.StringVar(&config.MetricsAddr, "listen", config.MetricsAddr, "serve /metrics, /healthz and /readyz on this address, such as :9187")
+	flags.Parse(args)
+
+	if err := validateConfig(config); err != nil {
+		log.Fatalf("Configuration error: %v", err)
+	}
+	if config.MonitorInterval <= 0 {
+		log.Fatalf("Configuration error: the monitor interval must be positive")
+	}
+
+	db, err := connectWithRetry(config)
+	if err != nil {
+		log.Fatalf("Failed to connect to PostgreSQL: %v", err)
+	}
+	defer db.Close()
+
+	// Sizes are parsed by the server, like EXOQUIC_MAX_SLOT_WAL_KEEP_SIZE
+	thresholds := monitorThresholds{MaxInactive: config.AlertInactive}
+	if thresholds.MaxRetainedBytes, err = parseThreshold(db, *maxRetained); err != nil {
+		log.Fatalf("Configuration error: max retained WAL: %v", err)
+	}
+	if thresholds.MaxFlushLagBytes, err = parseThreshold(db, *maxLag); err != nil {
+		log.Fatalf("Configuration error: max flush lag: %v", err)
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	var metrics *metricsServer
+	if config.MetricsAddr != "" {
+		metrics = newMetricsServer(config)
+		go serveMetrics(ctx, config.MetricsAddr, metrics)
+	}
+
+	monitor := newSlotMonitor(thresholds)
+	log.Printf("Monitoring replication slot %s every %v", config.SlotName, config.MonitorInterval)
+	monitorLoop(ctx, db, config, monitor, metrics)
+	log.Println("Monitor stopped")
+}
+
+// Sample the slot every interval until ctx is done, updating the metrics unless they are nil
+func monitorLoop(ctx context.Context, db *sql.DB, config Config, monitor *slotMonitor, metrics *metricsServer) {
+	ticker := time.NewTicker(config.MonitorInterval)
+	defer ticker.Stop()
+
+	for {
+		// database/sql reconnects on the next query if the server went away
+		sample, err := sampleSlot(db, config.SlotName)
+		if err != nil {
+			log.Printf("Warning: %v", err)
+		} else {
+			for _, event := range monitor.observe(sample) {
+				log.Println(event)
+			}
+			log.Println(monitor.describe(config.SlotName, sample))
+		}
+
+		if metrics != nil {
+			if err == nil {
+				var replication replicationMetrics
+				replication, err = queryReplicationMetrics(db, config, sample)
+				if err != nil {
+					log.Printf("Warning: %v", err)
+				} else {
+					metrics.update(replication)
+				}
+			}
+			if err != nil {
+				metrics.failed()
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Parse an alert threshold such as 5GB, empty disables the alert
+func parseThreshold(db *sql.DB, size string) (int64, error) {
+	if strings.TrimSpace(size) == "" {
+		return 0, nil
+	}
+	bytes, err := querySizeBytes(db, size)
+	if err != nil || bytes < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected a number with an optional unit such as 5GB", size)
+	}
+	return bytes, nil
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// An entry of TABLES_TO_CAPTURE: a table name, a glob such as billing.* or
+// user_*, or a regular expression between slashes matched against
+// schema.table. A leading ! turns it into an exclusion.
+type tablePattern struct {
+	Text    string // as written, for reports
+	Exclude bool
+	match   func(tableName) bool
+}
+
+// Split TABLES_TO_CAPTURE into its entries. Commas inside double quotes and
+// inside a regular expression, such as in /t{1,3}/, don't separate entries.
+func splitTablePatterns(value string) []string {
+	var entries []string
+	var entry strings.Builder
+	inQuotes, inRegexp := false, false
+
+	for i := 0; i < len(value); i++ {
+		c := value[i]
+		switch {
+		case inRegexp:
+			// The regular expression ends at a slash followed by the next entry or the end
+			if c == '/' {
+				rest := strings.TrimLeft(value[i+1:], " \t")
+				inRegexp = rest != "" && rest[0] != ','
+			}
+		case c == '"':
+			inQuotes = !inQuotes
+		case c == '/' && !inQuotes && strings.Trim(entry.String(), " \t!") == "":
+			inRegexp = true
+		case c == ',' && !inQuotes:
+			if text := strings.TrimSpace(entry.String()); text != "" {
+				entries = append(entries, text)
+			}
+			entry.Reset()
+			continue
+		}
+		entry.WriteByte(c)
+	}
+
+	if text := strings.TrimSpace(entry.String()); text != "" {
+		entries = append(entries, text)
+	}
+	return entries
+}
+
+// Parse an entry of TABLES_TO_CAPTURE. Names and globs without a schema are in
+// the public schema, except in exclusions where they match every schema.
+// Regular expressions are matched against schema.table.
+// Double-quoted parts of a name are literal, * and ? in them match themselves.
+func parseTablePattern(text string) (tablePattern, error) {
+	pattern := tablePattern{Text: strings.TrimSpace(text)}
+	body := pattern.Text
+	if strings.HasPrefix(body, "!") {
+		pattern.Exclude = true
+		body = strings.TrimSpace(body[1:])
+	}
+
+	if len(body) >= 2 && strings.HasPrefix(body, "/") && strings.HasSuffix(body, "/") {
+		re, err := regexp.Compile("^(?:" + body[1:len(body)-1] + ")$")
+		if err != nil {
+			return pattern, fmt.Errorf("invalid regular expression %q: %v", pattern.Text, err)
+		}
+		pattern.match = func(t tableName) bool { return re.MatchString(t.String()) }
+		return pattern, nil
+	}
+
+	parts, err := splitQualifiedNameParts(body)
+	if err != nil {
+		return pattern, err
+	}
+
+	var schema, table *regexp.Regexp
+	switch len(parts) {
+	case 1:
+		schema, table = regexp.MustCompile("^public$"), globRegexp(parts[0])
+		if pattern.Exclude {
+			schema = regexp.MustCompile("")
+		}
+	case 2:
+		schema, table = globRegexp(parts[0]), globRegexp(parts[1])
+	default:
+		return pattern, fmt.Errorf("invalid table pattern %q: expected table or schema.table", pattern.Text)
+	}
+	pattern.match = func(t tableName) bool { return schema.MatchString(t.Schema) && table.MatchString(t.Name) }
+	return pattern, nil
+}
+
+// Translate a glob, where * matches any characters and ? a single one unless
+// they were inside double quotes
+func globRegexp(glob namePart) *regexp.Regexp {
+	var re, literal strings.Builder
+	re.WriteString("^")
+	for i := 0; i < len(glob.Text); i++ {
+		c := glob.Text[i]
+		if glob.quoted[i] || (c != '*' && c != '?') {
+			literal.WriteByte(c)
+			continue
+		}
+		re.WriteString(regexp.QuoteMeta(literal.String()))
+		literal.Reset()
+		if c == '*' {
+			re.WriteString(".*")
+		} else {
+			re.WriteString(".")
+		}
+	}
+	re.WriteString(regexp.QuoteMeta(literal.String()))
+	re.WriteString("$")
+	return regexp.MustCompile(re.String())
+}
+
+// Expand the patterns into the tables they select from the candidates. Without
+// include patterns every candidate is included. A pattern that matches or
+// excludes nothing is an error, most likely a typo.
+func expandTablePatterns(patterns []tablePattern, candidates []tableName, result *strings.Builder) ([]tableName, error) {
+	selected := make(map[tableName]bool)
+	hasIncludes := false
+	for _, pattern := range patterns {
+		if pattern.Exclude {
+			continue
+		}
+		hasIncludes = true
+
+		matched := matchTables(pattern, candidates)
+		if len(matched) == 0 {
+			return nil, fmt.Errorf("%s in TABLES_TO_CAPTURE matches no table in the captured schemas", pattern.Text)
+		}
+		for _, table := range matched {
+			selected[table] = true
+		}
+		result.WriteString(fmt.Sprintf("%s matched %s.\n", pattern.Text, describeTables(matched)))
+	}
+
+	if !hasIncludes {
+		for _, table := range candidates {
+			selected[table] = true
+		}
+	}
+
+	for _, pattern := range patterns {
+		if !pattern.Exclude {
+			continue
+		}
+
+		var excluded []tableName
+		for _, table := range matchTables(pattern, candidates) {
+			if selected[table] {
+				excluded = append(excluded, table)
+				delete(selected, table)
+			}
+		}
+		if len(excluded) == 0 {
+			return nil, fmt.Errorf("%s in TABLES_TO_CAPTURE excludes no table", pattern.Text)
+		}
+		result.WriteString(fmt.Sprintf("%s excluded %s.\n", pattern.Text, describeTables(excluded)))
+	}
+
+	tables := make([]tableName, 0, len(selected))
+	for table := range selected {
+		tables = append(tables, table)
+	}
+	sortTableNames(tables)
+	return tables, nil
+}
+
+func matchTables(pattern tablePattern, candidates []tableName) []tableName {
+	var matched []tableName
+	for _, table := range candidates {
+		if pattern.match(table) {
+			matched = append(matched, table)
+		}
+	}
+	return matched
+}
+
+func describeTables(tables []tableName) string {
+	names := make([]string, len(tables))
+	for i, table := range tables {
+		names[i] = table.String()
+	}
+	return strings.Join(names, ", ")
+}
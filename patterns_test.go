@@ -0,0 +1,113 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestSplitTablePatterns(t *testing.T) {
+	tests := []struct {
+		value   string
+		entries []string
+	}{
+		{"", nil},
+		{"users, orders ,", []string{"users", "orders"}},
+		{"/t{1,3}/,users", []string{"/t{1,3}/", "users"}},
+		{"!/a{2,}/ , b", []string{"!/a{2,}/", "b"}},
+		{`"odd,name".t,users`, []string{`"odd,name".t`, "users"}},
+	}
+
+	for _, test := range tests {
+		if entries := splitTablePatterns(test.value); !reflect.DeepEqual(entries, test.entries) {
+			t.Errorf("splitTablePatterns(%q) = %q, want %q", test.value, entries, test.entries)
+		}
+	}
+}
+
+func TestTablePatternMatching(t *testing.T) {
+	candidates := []tableName{
+		{"public", "orders"},
+		{"public", "order_items"},
+		{"billing", "orders"},
+		{"billing", "order_items"},
+		{"public", "tt"},
+		{"public", "a*b"},
+		{"public", "axb"},
+	}
+
+	tests := []struct {
+		pattern string
+		matched string
+	}{
+		{"orders", "public.orders"},
+		{"order*", "public.orders, public.order_items"},
+		{"*.order*", "public.orders, public.order_items, billing.orders, billing.order_items"},
+		{"billing.order?items", "billing.order_items"},
+		{`"a*b"`, "public.a*b"},
+		{"a*b", "public.a*b, public.axb"},
+		{"/public\\.t{1,3}/", "public.tt"},
+		// Exclusions without a schema match every schema
+		{"!order*", "public.orders, public.order_items, billing.orders, billing.order_items"},
+		{"!billing.orders", "billing.orders"},
+	}
+
+	for _, test := range tests {
+		pattern, err := parseTablePattern(test.pattern)
+		if err != nil {
+			t.Errorf("parseTablePattern(%q) error = %v", test.pattern, err)
+			continue
+		}
+		if matched := describeTables(matchTables(pattern, candidates)); matched != test.matched {
+			t.Errorf("%s matched %s, want %s", test.pattern, matched, test.matched)
+		}
+	}
+}
+
+func TestExpandTablePatterns(t *testing.T) {
+	candidates := []tableName{
+		{"public", "orders"},
+		{"public", "orders_tmp"},
+		{"billing", "invoices"},
+		{"billing", "invoices_tmp"},
+	}
+
+	tests := []struct {
+		patterns []string
+		tables   string
+		err      string
+	}{
+		{patterns: []string{"!*_tmp"}, tables: "billing.invoices, public.orders"},
+		{patterns: []string{"billing.*", "!*_tmp"}, tables: "billing.invoices"},
+		{patterns: []string{"missing"}, err: "missing in TABLES_TO_CAPTURE matches no table"},
+		{patterns: []string{"!*_temp"}, err: "!*_temp in TABLES_TO_CAPTURE excludes no table"},
+		{patterns: []string{"billing.*", "!public.*"}, err: "!public.* in TABLES_TO_CAPTURE excludes no table"},
+	}
+
+	for _, test := range tests {
+		var patterns []tablePattern
+		for _, text := range test.patterns {
+			pattern, err := parseTablePattern(text)
+			if err != nil {
+				t.Fatalf("parseTablePattern(%q) error = %v", text, err)
+			}
+			patterns = append(patterns, pattern)
+		}
+
+		var result strings.Builder
+		tables, err := expandTablePatterns(patterns, candidates, &result)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("expandTablePatterns(%q) error = %v, want %q", test.patterns, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("expandTablePatterns(%q) error = %v", test.patterns, err)
+			continue
+		}
+		if got := describeTables(tables); got != test.tables {
+			t.Errorf("expandTablePatterns(%q) = %s, want %s", test.patterns, got, test.tables)
+		}
+	}
+}
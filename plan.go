@@ -0,0 +1,246 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// Returned for a change the current user isn't allowed to make
+var errManualStep = errors.New("insufficient privileges, manual step required")
+
+// A single change made to the database, or proposed in dry-run mode
+type Change struct {
+	Step   string `json:"step"`
+	Action string `json:"action"` // create, alter, drop, add, remove, grant, revoke, reload or migrate
+	Object string `json:"object"`
+	From   string `json:"from,omitempty"`
+	To     string `json:"to,omitempty"`
+	SQL    string `json:"sql"`
+
+	// Executed instead of SQL when the shown statement has secrets redacted
+	statement string
+	// Statement that restores the previous state, recorded for teardown
+	undo string
+}
+
+// Plan records the changes made by the step functions. In dry-run mode the
+// statements are only recorded and never executed.
+type Plan struct {
+	DryRun  bool          `json:"dryRun"`
+	Changes []Change      `json:"changes"`
+	Manual  []ManualStep  `json:"manual"`
+	Notes   []StepMessage `json:"notes"`
+	Errors  []StepMessage `json:"errors"`
+}
+
+// A step the current user isn't allowed to run, with instructions to do it by hand
+type ManualStep struct {
+	Step         string `json:"step"`
+	Description  string `json:"description"`
+	Instructions string `json:"instructions"`
+}
+
+// Something a step reports besides its changes, such as the tables a pattern
+// matched or the error the step failed with
+type StepMessage struct {
+	Step    string `json:"step"`
+	Message string `json:"message"`
+}
+
+// Execute the statement of a change unless this is a dry run
+func (p *Plan) exec(db *sql.DB, change Change) error {
+	if !p.DryRun {
+		statement := change.statement
+		if statement == "" {
+			statement = change.SQL
+		}
+		if _, err := db.Exec(statement); err != nil {
+			return err
+		}
+	}
+	p.Changes = append(p.Changes, change)
+	return nil
+}
+
+// Execute the statement of a change followed by the given statements in one
+// transaction, unless this is a dry run
+func (p *Plan) execTx(db *sql.DB, change Change, followUp ...string) error {
+	if !p.DryRun {
+		statement := change.statement
+		if statement == "" {
+			statement = change.SQL
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, s := range append([]string{statement}, followUp...) {
+			if _, err := tx.Exec(s); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	p.Changes = append(p.Changes, change)
+	return nil
+}
+
+// Record a step that has to be done by hand
+func (p *Plan) manual(step, description, instructions string) {
+	p.Manual = append(p.Manual, ManualStep{Step: step, Description: description, Instructions: instructions})
+}
+
+// Record the lines of a step report that explain the plan
+func (p *Plan) note(step, report string) {
+	for _, line := range strings.Split(report, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			p.Notes = append(p.Notes, StepMessage{Step: step, Message: line})
+		}
+	}
+}
+
+// Record a step that failed
+func (p *Plan) fail(step string, err error) {
+	p.Errors = append(p.Errors, StepMessage{Step: step, Message: err.Error()})
+}
+
+// Render the notes and failed steps, empty if there are none
+func (p *Plan) MessagesString() string {
+	var result strings.Builder
+	for _, section := range []struct {
+		title    string
+		messages []StepMessage
+	}{
+		{"Notes", p.Notes},
+		{"Failed Steps", p.Errors},
+	} {
+		if len(section.messages) == 0 {
+			continue
+		}
+		if result.Len() > 0 {
+			result.WriteString("\n")
+		}
+		result.WriteString(section.title + ":\n")
+		result.WriteString(strings.Repeat("-", len(section.title)+1) + "\n")
+		for _, m := range section.messages {
+			result.WriteString(fmt.Sprintf("  %s: %s\n", m.Step, m.Message))
+		}
+	}
+	return result.String()
+}
+
+// Render the manual steps, empty if there are none
+func (p *Plan) ManualString() string {
+	if len(p.Manual) == 0 {
+		return ""
+	}
+
+	var result strings.Builder
+	result.WriteString("Manual Steps Required:\n")
+	result.WriteString("---------------------\n")
+	for i, m := range p.Manual {
+		result.WriteString(fmt.Sprintf("%d. %s: %s\n", i+1, m.Step, m.Description))
+		for _, line := range strings.Split(m.Instructions, "\n") {
+			result.WriteString("   " + line + "\n")
+		}
+	}
+	return result.String()
+}
+
+func actionSymbol(action string) string {
+	switch action {
+	case "create", "add", "grant":
+		return "+"
+	case "drop", "remove", "revoke":
+		return "-"
+	}
+	return "~"
+}
+
+// Render the plan as a human-readable diff grouped by step
+func (p *Plan) String() string {
+	var result strings.Builder
+
+	if len(p.Changes) == 0 {
+		switch {
+		case len(p.Errors) > 0:
+			result.WriteString("No changes planned, some steps failed.\n")
+		case len(p.Manual) == 0:
+			result.WriteString("No changes. The database is already configured for Exoquic.\n")
+		default:
+			result.WriteString("No changes can be made by the current user.\n")
+		}
+		if messages := p.MessagesString(); messages != "" {
+			result.WriteString("\n" + messages)
+		}
+		if manual := p.ManualString(); manual != "" {
+			result.WriteString("\n" + manual)
+		}
+		return result.String()
+	}
+
+	step := ""
+	for _, change := range p.Changes {
+		if change.Step != step {
+			if step != "" {
+				result.WriteString("\n")
+			}
+			step = change.Step
+			result.WriteString(step + ":\n")
+		}
+
+		line := fmt.Sprintf("  %s %s %s", actionSymbol(change.Action), change.Action, change.Object)
+		if change.From != "" || change.To != "" {
+			line += fmt.Sprintf(": %s -> %s", valueOrNone(change.From), valueOrNone(change.To))
+		}
+		result.WriteString(line + "\n")
+	}
+
+	verb := "made"
+	if p.DryRun {
+		verb = "planned"
+	}
+	result.WriteString(fmt.Sprintf("\n%d change(s) %s.\n", len(p.Changes), verb))
+	if messages := p.MessagesString(); messages != "" {
+		result.WriteString("\n" + messages)
+	}
+	if manual := p.ManualString(); manual != "" {
+		result.WriteString("\n" + manual)
+	}
+	return result.String()
+}
+
+// Render the plan as indented JSON
+func (p *Plan) JSON() (string, error) {
+	if p.Changes == nil {
+		p.Changes = []Change{}
+	}
+	if p.Manual == nil {
+		p.Manual = []ManualStep{}
+	}
+	if p.Notes == nil {
+		p.Notes = []StepMessage{}
+	}
+	if p.Errors == nil {
+		p.Errors = []StepMessage{}
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return "", fmt.Errorf("failed to serialize plan: %v", err)
+	}
+	return string(data) + "\n", nil
+}
+
+func valueOrNone(value string) string {
+	if value == "" {
+		return "(none)"
+	}
+	return value
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Where the server runs. Managed providers don't allow ALTER SYSTEM, logical
+// replication is turned on through their own parameter or console setting.
+type Provider struct {
+	Name        string // rds, aurora, cloudsql, azure, neon, supabase or self-hosted
+	DisplayName string
+	// Provider setting that turns on logical replication, empty if wal_level is set directly
+	LogicalSetting string
+	// Current value of LogicalSetting
+	LogicalValue string
+	// What the detection was based on, for the log
+	Evidence string
+}
+
+var selfHosted = Provider{Name: "self-hosted", DisplayName: "self-hosted PostgreSQL"}
+
+// Managed providers need their own instructions instead of ALTER SYSTEM
+func (p Provider) Managed() bool {
+	return p.Name != selfHosted.Name
+}
+
+// Detect the provider from settings, functions, roles and extensions only it installs
+func detectProvider(db *sql.DB) (Provider, error) {
+	var rdsLogical, cloudSQLLogical, azureExtensions, neonTimeline sql.NullString
+	var aurora bool
+	var roles, extensions []string
+	err := db.QueryRow(`
+		SELECT current_setting('rds.logical_replication', true),
+			current_setting('cloudsql.logical_decoding', true),
+			current_setting('azure.extensions', true),
+			current_setting('neon.timeline_id', true),
+			EXISTS(SELECT 1 FROM pg_proc WHERE proname = 'aurora_version'),
+			ARRAY(SELECT rolname FROM pg_roles WHERE rolname = ANY($1) ORDER BY rolname),
+			ARRAY(SELECT extname FROM pg_extension WHERE extname IN ('neon', 'supabase_vault') ORDER BY extname)
+	`, pq.Array(managedAdminRoles)).Scan(&rdsLogical, &cloudSQLLogical, &azureExtensions, &neonTimeline,
+		&aurora, pq.Array(&roles), pq.Array(&extensions))
+	if err != nil {
+		return selfHosted, fmt.Errorf("failed to detect provider: %v", err)
+	}
+
+	has := func(list []string, name string) bool {
+		for _, item := range list {
+			if item == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	switch {
+	case aurora:
+		return Provider{Name: "aurora", DisplayName: "Amazon Aurora PostgreSQL", LogicalSetting: "rds.logical_replication",
+			LogicalValue: rdsLogical.String, Evidence: "aurora_version() function"}, nil
+	case rdsLogical.Valid:
+		return Provider{Name: "rds", DisplayName: "Amazon RDS for PostgreSQL", LogicalSetting: "rds.logical_replication",
+			LogicalValue: rdsLogical.String, Evidence: "rds.logical_replication setting"}, nil
+	case cloudSQLLogical.Valid:
+		return Provider{Name: "cloudsql", DisplayName: "Google Cloud SQL for PostgreSQL", LogicalSetting: "cloudsql.logical_decoding",
+			LogicalValue: cloudSQLLogical.String, Evidence: "cloudsql.logical_decoding setting"}, nil
+	case azureExtensions.Valid || has(roles, "azure_pg_admin"):
+		return Provider{Name: "azure", DisplayName: "Azure Database for PostgreSQL", Evidence: "azure.extensions setting or azure_pg_admin role"}, nil
+	case neonTimeline.Valid || has(extensions, "neon") || has(roles, "neon_superuser"):
+		return Provider{Name: "neon", DisplayName: "Neon", Evidence: "neon settings, extension or role"}, nil
+	case has(roles, "supabase_admin") || has(extensions, "supabase_vault"):
+		return Provider{Name: "supabase", DisplayName: "Supabase", Evidence: "supabase_admin role or supabase_vault extension"}, nil
+	case has(roles, "rds_superuser"):
+		// Older RDS versions without the setting visible to the current user
+		return Provider{Name: "rds", DisplayName: "Amazon RDS for PostgreSQL", LogicalSetting: "rds.logical_replication",
+			Evidence: "rds_superuser role"}, nil
+	case has(roles, "cloudsqlsuperuser"):
+		return Provider{Name: "cloudsql", DisplayName: "Google Cloud SQL for PostgreSQL", LogicalSetting: "cloudsql.logical_decoding",
+			Evidence: "cloudsqlsuperuser role"}, nil
+	}
+
+	return selfHosted, nil
+}
+
+// Whether the provider setting that turns on logical replication is on
+func (p Provider) logicalEnabled() bool {
+	switch strings.ToLower(p.LogicalValue) {
+	case "on", "1", "true", "yes":
+		return true
+	}
+	return false
+}
+
+// A WAL setting that has to change
+type settingChange struct {
+	Name string
+	From string
+	To   string
+	SQL  string
+}
+
+// Provider-specific instructions for changing the WAL settings without ALTER SYSTEM
+func (p Provider) walInstructions(changes []settingChange) string {
+	var result strings.Builder
+
+	// Settings other than wal_level keep their own names at every provider
+	var limits []settingChange
+	needsLogical := false
+	for _, change := range changes {
+		if change.Name == "wal_level" {
+			needsLogical = true
+		} else {
+			limits = append(limits, change)
+		}
+	}
+
+	switch p.Name {
+	case "rds", "aurora":
+		group := "DB parameter group of the instance"
+		if p.Name == "aurora" {
+			group = "DB cluster parameter group of the cluster"
+		}
+		result.WriteString(fmt.Sprintf("In the %s set:", group))
+		if needsLogical {
+			result.WriteString("\n  rds.logical_replication = 1")
+		}
+		for _, change := range limits {
+			result.WriteString(fmt.Sprintf("\n  %s = %s", change.Name, change.To))
+		}
+		result.WriteString("\nThen reboot the instance, the parameters are static.")
+	case "cloudsql":
+		var flags []string
+		if needsLogical {
+			flags = append(flags, "cloudsql.logical_decoding=on")
+		}
+		for _, change := range limits {
+			flags = append(flags, fmt.Sprintf("%s=%s", change.Name, change.To))
+		}
+		result.WriteString("Set the database flags in the console under Edit > Flags, or with:\n")
+		result.WriteString(fmt.Sprintf("  gcloud sql instances patch <instance> --database-flags=%s\n", strings.Join(flags, ",")))
+		result.WriteString("--database-flags replaces all flags of the instance, include the existing ones. Cloud SQL restarts the instance.")
+	case "azure":
+		result.WriteString("Under Settings > Server parameters in the Azure portal set:")
+		for _, change := range changes {
+			result.WriteString(fmt.Sprintf("\n  %s = %s", change.Name, change.To))
+		}
+		result.WriteString("\nSave and restart the server, or use:")
+		for _, change := range changes {
+			result.WriteString(fmt.Sprintf("\n  az postgres flexible-server parameter set --resource-group <group> --server-name <server> --name %s --value %s",
+				change.Name, change.To))
+		}
+	case "neon":
+		result.WriteString("Enable logical replication in the Neon console under Project settings > Logical Replication.\n")
+		result.WriteString("Neon sets wal_level and the replication limits and restarts the compute. This can't be undone for the project.")
+	case "supabase":
+		if needsLogical {
+			result.WriteString("wal_level is logical on every Supabase project, contact Supabase support.\n")
+		}
+		var configs []string
+		for _, change := range limits {
+			configs = append(configs, fmt.Sprintf("--config %s=%s", change.Name, change.To))
+		}
+		if len(configs) > 0 {
+			result.WriteString("Raise the limits with the Supabase CLI, the database is restarted:\n")
+			result.WriteString("  supabase --experimental --project-ref <ref> postgres-config update " + strings.Join(configs, " "))
+		}
+	default:
+		result.WriteString("Ask a superuser to run the following and restart the server:")
+		for _, change := range changes {
+			result.WriteString("\n  " + change.SQL + ";")
+		}
+	}
+
+	return strings.TrimSuffix(result.String(), "\n")
+}
+
+// How to restart the server so that the WAL settings take effect
+func (p Provider) restartInstructions() string {
+	switch p.Name {
+	case "rds":
+		return "Reboot the instance in the RDS console or with: aws rds reboot-db-instance --db-instance-identifier <instance>"
+	case "aurora":
+		return "Reboot the writer instance in the RDS console or with: aws rds reboot-db-instance --db-instance-identifier <writer>"
+	case "cloudsql":
+		return "Restart the instance with: gcloud sql instances restart <instance>"
+	case "azure":
+		return "Restart the server with: az postgres flexible-server restart --resource-group <group> --name <server>"
+	case "neon":
+		return "Restart the compute of the branch in the Neon console."
+	case "supabase":
+		return "Restart the project in the Supabase dashboard under Project settings > General."
+	}
+	return "To restart PostgreSQL, you may need to run:\n" +
+		"  - For systemd: sudo systemctl restart postgresql\n" +
+		"  - For Docker: docker restart <container_name>\n" +
+		"  - For Railway.app: Redeploy the PostgreSQL service"
+}
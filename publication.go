@@ -0,0 +1,575 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// What the publication should contain
+type publicationTarget struct {
+	AllTables bool
+	Schemas   []string // FOR TABLES IN SCHEMA, PostgreSQL 15+
+	Tables    []tableName
+	Specs     map[tableName]tableSpec // column lists and row filters of some of the tables
+	Unowned   map[tableName]bool      // tables the current user isn't allowed to add
+	Unchecked map[tableName]bool      // tables whose row filter the server couldn't check
+}
+
+// The FOR clause of CREATE PUBLICATION
+func (t publicationTarget) clause() string {
+	if t.AllTables {
+		return "ALL TABLES"
+	}
+
+	var objects []string
+	if len(t.Schemas) > 0 {
+		quoted := make([]string, len(t.Schemas))
+		for i, schema := range t.Schemas {
+			quoted[i] = quoteIdent(schema)
+		}
+		objects = append(objects, "TABLES IN SCHEMA "+strings.Join(quoted, ", "))
+	}
+	if len(t.Tables) > 0 {
+		quoted := make([]string, len(t.Tables))
+		for i, table := range t.Tables {
+			quoted[i] = table.quoted() + t.Specs[table].sql()
+		}
+		objects = append(objects, "TABLE "+strings.Join(quoted, ", "))
+	}
+	return strings.Join(objects, ", ")
+}
+
+// The target as shown in reports
+func (t publicationTarget) String() string {
+	if t.AllTables {
+		return "all tables"
+	}
+
+	var parts []string
+	if len(t.Schemas) > 0 {
+		parts = append(parts, "all tables in "+describeSchemas(t.Schemas))
+	}
+	if len(t.Tables) > 0 {
+		parts = append(parts, describeTables(t.Tables))
+	}
+	return strings.Join(parts, " and ")
+}
+
+// Resolve what to publish, reporting what each pattern matched. An empty table
+// list without a schema filter means all tables, which needs a superuser unless
+// the publication is already for all tables. Unless the publication is for all
+// tables the heartbeat table is added, FOR ALL TABLES already includes it.
+func resolvePublicationTarget(db *sql.DB, caps Capabilities, config Config, schemas []string, options publicationOptions, existingAllTables, dryRun bool, result *strings.Builder) (publicationTarget, error) {
+	var target publicationTarget
+	switch {
+	case config.CaptureMode == "schema" && caps.ServerVersion >= 150000 && caps.Superuser:
+		// New tables in the schemas are published without running apply again
+		target.Schemas = schemas
+	case len(config.TablesToCapture) > 0:
+		patterns := make([]tablePattern, 0, len(config.TablesToCapture))
+		for _, text := range config.TablesToCapture {
+			pattern, err := parseTablePattern(text)
+			if err != nil {
+				return target, err
+			}
+			patterns = append(patterns, pattern)
+		}
+
+		// Patterns are resolved against the tables that exist right now
+		candidates, err := schemaTables(db, schemas)
+		if err != nil {
+			return target, err
+		}
+		if target.Tables, err = expandTablePatterns(patterns, candidates, result); err != nil {
+			return target, err
+		}
+		if len(target.Tables) == 0 && !config.Heartbeat {
+			return target, fmt.Errorf("TABLES_TO_CAPTURE excludes every table")
+		}
+	case config.schemaFilter() || config.CaptureMode == "schema" || len(config.TableSpecs) > 0 || !(caps.Superuser || existingAllTables):
+		switch {
+		case config.CaptureMode == "schema" && caps.ServerVersion < 150000:
+			result.WriteString("WARNING: FOR TABLES IN SCHEMA needs PostgreSQL 15 or later, publishing the tables that exist now instead. Run apply again to publish tables created later.\n")
+		case config.CaptureMode == "schema":
+			result.WriteString("WARNING: FOR TABLES IN SCHEMA needs a superuser, publishing the tables that exist now instead. Run apply again to publish tables created later.\n")
+		case !config.schemaFilter() && len(config.TableSpecs) == 0:
+			result.WriteString("WARNING: FOR ALL TABLES needs a superuser, publishing the tables that exist now instead. Run apply again to publish tables created later.\n")
+		}
+
+		var err error
+		if target.Tables, err = schemaTables(db, schemas); err != nil {
+			return target, err
+		}
+		if len(target.Tables) == 0 && !config.Heartbeat {
+			return target, fmt.Errorf("no tables found in %s", describeSchemas(schemas))
+		}
+	default:
+		target.AllTables = true
+		return target, nil
+	}
+
+	if config.Heartbeat {
+		heartbeat, _ := parseTableName(heartbeatTable)
+		found := false
+		for _, table := range target.Tables {
+			found = found || table == heartbeat
+		}
+		if !found {
+			target.Tables = append(target.Tables, heartbeat)
+		}
+	}
+
+	// Only the owner of a table can add it to a publication
+	unowned, err := unownedTables(db, caps, target.Tables)
+	if err != nil {
+		return target, err
+	}
+	target.Unowned = unowned
+
+	// The server checks the row filters in a scratch CREATE PUBLICATION, which
+	// needs the same privileges as the publication itself. plan never runs it.
+	var filtered []tableName
+	for table, spec := range config.TableSpecs {
+		if spec.Where != "" {
+			filtered = append(filtered, table)
+		}
+	}
+	sortTableNames(filtered)
+	canCheckFilters := caps.CreateOnDatabase
+	for _, table := range filtered {
+		canCheckFilters = canCheckFilters && !unowned[table]
+	}
+
+	specs, err := checkTableSpecs(db, caps, config.TableSpecs, target.Tables, canCheckFilters && !dryRun, options.publishes("update") || options.publishes("delete"))
+	if err != nil {
+		return target, err
+	}
+	target.Specs = specs
+
+	if len(filtered) > 0 && !canCheckFilters {
+		// Filters as written are only ever run by hand
+		target.Unchecked = make(map[tableName]bool)
+		for _, table := range filtered {
+			target.Unchecked[table] = true
+		}
+		result.WriteString(fmt.Sprintf("MANUAL: The row filters of %s can't be checked without CREATE on the database and ownership of the tables, review them in the manual statements.\n",
+			describeTables(filtered)))
+	} else if len(filtered) > 0 && dryRun {
+		result.WriteString(fmt.Sprintf("INFO: The row filters of %s are checked by the server when apply runs.\n", describeTables(filtered)))
+	}
+	for _, table := range target.Tables {
+		if spec, ok := specs[table]; ok {
+			result.WriteString(fmt.Sprintf("Publishing %s of %s.\n", spec, table))
+		}
+	}
+	return target, nil
+}
+
+// Create the publication, or reconcile an existing one with the tables to capture
+func createPublication(db *sql.DB, plan *Plan, caps Capabilities, config Config, schemas []string) (string, error) {
+	var result strings.Builder
+	publicationName := config.PublicationName
+
+	options, err := desiredPublicationOptions(caps, config)
+	if err != nil {
+		return "", err
+	}
+
+	// The heartbeat is an UPDATE, without it being published the slot has nothing to acknowledge
+	if config.Heartbeat && !config.HeartbeatMessage && !options.publishes("update") {
+		result.WriteString("WARNING: EXOQUIC_PUBLISH leaves out update, so heartbeats don't reach Exoquic and idle databases retain WAL. Publish update or set EXOQUIC_HEARTBEAT_EMIT_MESSAGE=true.\n")
+	}
+
+	// Check if publication exists
+	var allTables bool
+	err = db.QueryRow("SELECT puballtables FROM pg_publication WHERE pubname = $1", publicationName).Scan(&allTables)
+	publicationExists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return "", fmt.Errorf("failed to check if publication exists: %v", err)
+	}
+
+	target, err := resolvePublicationTarget(db, caps, config, schemas, options, publicationExists && allTables, plan.DryRun, &result)
+	if err != nil {
+		return "", err
+	}
+	// What the patterns matched explains the tables in the plan
+	plan.note("Publication", result.String())
+
+	if publicationExists && allTables == target.AllTables {
+		result.WriteString(fmt.Sprintf("Publication %s already exists.\n", publicationName))
+		if target.AllTables {
+			result.WriteString("Publication already covers all tables.\n")
+		} else if err := reconcilePublicationObjects(db, plan, caps, publicationName, target, &result); err != nil {
+			return "", err
+		}
+		if err := reconcilePublicationOptions(db, plan, caps, publicationName, options, &result); err != nil {
+			return "", err
+		}
+		return result.String(), nil
+	}
+
+	createCmd := fmt.Sprintf("CREATE PUBLICATION %s FOR %s WITH (%s)", quoteIdent(publicationName), target.clause(), options.with(caps.ServerVersion))
+
+	if !caps.CreateOnDatabase || len(target.Unowned) > 0 {
+		statements := []string{createCmd}
+		if publicationExists {
+			statements = []string{fmt.Sprintf("DROP PUBLICATION %s", quoteIdent(publicationName)), createCmd}
+		}
+		plan.manual("Publication", "create publication "+publicationName, manualInstructions(caps, "", statements...))
+		if !caps.CreateOnDatabase {
+			result.WriteString(fmt.Sprintf("MANUAL: The current user has no CREATE privilege on the database, create %s by hand.\n", publicationName))
+		} else {
+			result.WriteString(fmt.Sprintf("MANUAL: The current user doesn't own %s, create %s by hand.\n", describeTables(sortedTables(target.Unowned)), publicationName))
+		}
+		return result.String(), nil
+	}
+
+	if publicationExists {
+		result.WriteString(fmt.Sprintf("Publication %s already exists.\n", publicationName))
+
+		// Switching between FOR ALL TABLES and an explicit list is only possible by recreating the publication
+		err = plan.exec(db, Change{
+			Step:   "Publication",
+			Action: "drop",
+			Object: "publication " + publicationName,
+			SQL:    fmt.Sprintf("DROP PUBLICATION %s", quoteIdent(publicationName)),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to drop existing publication: %v", err)
+		}
+		if target.AllTables {
+			result.WriteString("Dropped existing publication to recreate it for all tables.\n")
+		} else {
+			result.WriteString("Dropped existing publication to recreate it for the listed tables.\n")
+		}
+	}
+
+	// Create the publication
+	err = plan.exec(db, Change{
+		Step:   "Publication",
+		Action: "create",
+		Object: fmt.Sprintf("publication %s for %s", publicationName, target),
+		SQL:    createCmd,
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to create publication: %v", err)
+	}
+
+	result.WriteString(fmt.Sprintf("Created publication %s.\n", publicationName))
+	result.WriteString(fmt.Sprintf("Publication options: %s.\n", options))
+	return result.String(), nil
+}
+
+// Add and remove the schemas and tables of an existing publication.
+// Schemas are only published since PostgreSQL 15. They are added before and
+// removed after the tables, so a table moving between the two never drops out.
+func reconcilePublicationObjects(db *sql.DB, plan *Plan, caps Capabilities, publicationName string, target publicationTarget, result *strings.Builder) error {
+	var schemasToAdd, schemasToRemove []string
+	if caps.ServerVersion >= 150000 {
+		var err error
+		schemasToAdd, schemasToRemove, err = diffPublicationSchemas(db, publicationName, target.Schemas)
+		if err != nil {
+			return err
+		}
+	}
+	for _, schema := range schemasToAdd {
+		if err := alterPublicationSchema(db, plan, publicationName, schema, true, result); err != nil {
+			return err
+		}
+	}
+	if err := reconcilePublicationTables(db, plan, caps, publicationName, target, result); err != nil {
+		return err
+	}
+	for _, schema := range schemasToRemove {
+		if err := alterPublicationSchema(db, plan, publicationName, schema, false, result); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Compare the schemas in the publication with the schemas to capture
+func diffPublicationSchemas(db *sql.DB, publicationName string, schemas []string) ([]string, []string, error) {
+	rows, err := db.Query(`
+		SELECT n.nspname
+		FROM pg_publication_namespace pn
+		JOIN pg_publication p ON p.oid = pn.pnpubid
+		JOIN pg_namespace n ON n.oid = pn.pnnspid
+		WHERE p.pubname = $1
+	`, publicationName)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query publication schemas: %v", err)
+	}
+	defer rows.Close()
+
+	published := make(map[string]bool)
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		published[schema] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	var toAdd, toRemove []string
+	wanted := make(map[string]bool)
+	for _, schema := range schemas {
+		wanted[schema] = true
+		if !published[schema] {
+			toAdd = append(toAdd, schema)
+		}
+	}
+	for schema := range published {
+		if !wanted[schema] {
+			toRemove = append(toRemove, schema)
+		}
+	}
+	sort.Strings(toRemove)
+	return toAdd, toRemove, nil
+}
+
+// Add a schema to the publication or remove it
+func alterPublicationSchema(db *sql.DB, plan *Plan, publicationName, schema string, add bool, result *strings.Builder) error {
+	change := Change{
+		Step:   "Publication",
+		Action: "add",
+		Object: fmt.Sprintf("schema %s to publication %s", schema, publicationName),
+		SQL:    fmt.Sprintf("ALTER PUBLICATION %s ADD TABLES IN SCHEMA %s", quoteIdent(publicationName), quoteIdent(schema)),
+	}
+	if !add {
+		change.Action = "remove"
+		change.Object = fmt.Sprintf("schema %s from publication %s", schema, publicationName)
+		change.SQL = fmt.Sprintf("ALTER PUBLICATION %s DROP TABLES IN SCHEMA %s", quoteIdent(publicationName), quoteIdent(schema))
+	}
+
+	if err := plan.exec(db, change); err != nil {
+		return fmt.Errorf("failed to %s schema %s: %v", change.Action, schema, err)
+	}
+	if add {
+		result.WriteString(fmt.Sprintf("Added schema %s to publication.\n", schema))
+	} else {
+		result.WriteString(fmt.Sprintf("Removed schema %s from publication.\n", schema))
+	}
+	return nil
+}
+
+// Add and remove tables so that the publication matches the tables to capture.
+// A table whose column list or row filter changed is dropped and added again in
+// one transaction.
+func reconcilePublicationTables(db *sql.DB, plan *Plan, caps Capabilities, publicationName string, target publicationTarget, result *strings.Builder) error {
+	published, err := publicationTables(db, caps, publicationName)
+	if err != nil {
+		return err
+	}
+
+	wanted := make(map[tableName]bool)
+	for _, table := range target.Tables {
+		wanted[table] = true
+	}
+
+	var toAdd, toChange, toRemove []tableName
+	for table := range wanted {
+		if spec, ok := published[table]; !ok {
+			toAdd = append(toAdd, table)
+		} else if !spec.equal(target.Specs[table]) {
+			toChange = append(toChange, table)
+		}
+	}
+	for table := range published {
+		if !wanted[table] {
+			toRemove = append(toRemove, table)
+		}
+	}
+	sortTableNames(toAdd)
+	sortTableNames(toChange)
+	sortTableNames(toRemove)
+
+	if len(toAdd) == 0 && len(toChange) == 0 && len(toRemove) == 0 {
+		result.WriteString("Publication tables are up to date.\n")
+		return nil
+	}
+
+	// Tables owned by other roles, or with a row filter the server couldn't
+	// check, have to be added by hand
+	manual := func(table tableName) bool { return target.Unowned[table] || target.Unchecked[table] }
+	var manualStatements []string
+	for _, table := range append(append([]tableName{}, toAdd...), toChange...) {
+		if !manual(table) {
+			continue
+		}
+		if _, ok := published[table]; ok {
+			manualStatements = append(manualStatements, fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s", quoteIdent(publicationName), table.quoted()))
+		}
+		manualStatements = append(manualStatements, fmt.Sprintf("ALTER PUBLICATION %s ADD TABLE %s%s", quoteIdent(publicationName), table.quoted(), target.Specs[table].sql()))
+		if target.Unowned[table] {
+			result.WriteString(fmt.Sprintf("MANUAL: Add %s to the publication, the current user doesn't own it.\n", table))
+		} else {
+			result.WriteString(fmt.Sprintf("MANUAL: Add %s to the publication, its row filter wasn't checked.\n", table))
+		}
+	}
+	if len(manualStatements) > 0 {
+		plan.manual("Publication", "add tables to publication "+publicationName, manualInstructions(caps, "owner", manualStatements...))
+	}
+
+	for _, table := range toAdd {
+		if manual(table) {
+			continue
+		}
+		err = plan.exec(db, Change{
+			Step:   "Publication",
+			Action: "add",
+			Object: fmt.Sprintf("table %s to publication %s", table, publicationName),
+			SQL:    fmt.Sprintf("ALTER PUBLICATION %s ADD TABLE %s%s", quoteIdent(publicationName), table.quoted(), target.Specs[table].sql()),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to add table %s to publication: %v", table, err)
+		}
+		result.WriteString(fmt.Sprintf("Added table %s to publication.\n", table))
+	}
+
+	for _, table := range toChange {
+		if manual(table) {
+			continue
+		}
+		drop := fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s", quoteIdent(publicationName), table.quoted())
+		add := fmt.Sprintf("ALTER PUBLICATION %s ADD TABLE %s%s", quoteIdent(publicationName), table.quoted(), target.Specs[table].sql())
+		err = plan.execTx(db, Change{
+			Step:   "Publication",
+			Action: "alter",
+			Object: fmt.Sprintf("table %s in publication %s", table, publicationName),
+			From:   published[table].String(),
+			To:     target.Specs[table].String(),
+			SQL:    drop + "; " + add,
+
+			statement: drop,
+		}, add)
+		if err != nil {
+			return fmt.Errorf("failed to change table %s in publication: %v", table, err)
+		}
+		result.WriteString(fmt.Sprintf("Changed table %s in publication to %s.\n", table, target.Specs[table]))
+	}
+
+	for _, table := range toRemove {
+		err = plan.exec(db, Change{
+			Step:   "Publication",
+			Action: "remove",
+			Object: fmt.Sprintf("table %s from publication %s", table, publicationName),
+			SQL:    fmt.Sprintf("ALTER PUBLICATION %s DROP TABLE %s", quoteIdent(publicationName), table.quoted()),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to remove table %s from publication: %v", table, err)
+		}
+		result.WriteString(fmt.Sprintf("Removed table %s from publication.\n", table))
+	}
+
+	return nil
+}
+
+// Get the tables explicitly added to the publication with their column lists
+// and row filters, which only exist since PostgreSQL 15.
+// pg_publication_rel is used rather than pg_publication_tables, which lists the
+// partitions of a partitioned table instead of the table that was added.
+func publicationTables(db *sql.DB, caps Capabilities, publicationName string) (map[tableName]tableSpec, error) {
+	columns, filter := "'{}'::name[]", "''"
+	if caps.ServerVersion >= 150000 {
+		columns = `ARRAY(SELECT a.attname FROM pg_attribute a
+			WHERE a.attrelid = pr.prrelid AND a.attnum = ANY(pr.prattrs::int2[]) ORDER BY a.attnum)`
+		filter = "COALESCE(pg_get_expr(pr.prqual, pr.prrelid), '')"
+	}
+
+	rows, err := db.Query(`
+		SELECT n.nspname, c.relname, `+columns+`, `+filter+`
+		FROM pg_publication_rel pr
+		JOIN pg_publication p ON p.oid = pr.prpubid
+		JOIN pg_class c ON c.oid = pr.prrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE p.pubname = $1
+	`, publicationName)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query publication tables: %v", err)
+	}
+	defer rows.Close()
+
+	tables := make(map[tableName]tableSpec)
+	for rows.Next() {
+		var table tableName
+		var spec tableSpec
+		if err := rows.Scan(&table.Schema, &table.Name, pq.Array(&spec.Columns), &spec.Where); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		tables[table] = spec
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	return tables, nil
+}
+
+// Get the tables the current user doesn't own, none for a superuser
+func unownedTables(db *sql.DB, caps Capabilities, tables []tableName) (map[tableName]bool, error) {
+	unowned := make(map[tableName]bool)
+	if caps.Superuser || len(tables) == 0 {
+		return unowned, nil
+	}
+
+	schemas := make([]string, len(tables))
+	names := make([]string, len(tables))
+	for i, table := range tables {
+		schemas[i], names[i] = table.Schema, table.Name
+	}
+
+	rows, err := db.Query(`
+		SELECT n.nspname, c.relname
+		FROM unnest($1::text[], $2::text[]) AS t(schema_name, table_name)
+		JOIN pg_namespace n ON n.nspname = t.schema_name
+		JOIN pg_class c ON c.relnamespace = n.oid AND c.relname = t.table_name
+		WHERE NOT pg_has_role(c.relowner, 'USAGE')
+	`, pq.Array(schemas), pq.Array(names))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check table owners: %v", err)
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var table tableName
+		if err := rows.Scan(&table.Schema, &table.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		unowned[table] = true
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	return unowned, nil
+}
+
+// The tables of a set in sorted order
+func sortedTables(set map[tableName]bool) []tableName {
+	tables := make([]tableName, 0, len(set))
+	for table := range set {
+		tables = append(tables, table)
+	}
+	sortTableNames(tables)
+	return tables
+}
+
+func sortTableNames(tables []tableName) {
+	sort.Slice(tables, func(i, j int) bool {
+		if tables[i].Schema != tables[j].Schema {
+			return tables[i].Schema < tables[j].Schema
+		}
+		return tables[i].Name < tables[j].Name
+	})
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// The operations a publication can publish, in the order PostgreSQL lists them
+var publishOperations = []string{"insert", "update", "delete", "truncate"}
+
+// The WITH options of a publication
+type publicationOptions struct {
+	Publish          []string `json:"publish"`
+	ViaPartitionRoot bool     `json:"publishViaPartitionRoot"`
+}
+
+// Parse EXOQUIC_PUBLISH into the operations in canonical order, empty means all
+func parsePublishOperations(operations []string) ([]string, error) {
+	if len(operations) == 0 {
+		return append([]string{}, publishOperations...), nil
+	}
+
+	wanted := make(map[string]bool)
+	for _, operation := range operations {
+		operation = strings.ToLower(operation)
+		known := false
+		for _, o := range publishOperations {
+			known = known || o == operation
+		}
+		if !known {
+			return nil, fmt.Errorf("EXOQUIC_PUBLISH: unknown operation %q, expected insert, update, delete or truncate", operation)
+		}
+		wanted[operation] = true
+	}
+
+	var parsed []string
+	for _, operation := range publishOperations {
+		if wanted[operation] {
+			parsed = append(parsed, operation)
+		}
+	}
+	return parsed, nil
+}
+
+// The options apply sets, adjusted to what the server supports
+func desiredPublicationOptions(caps Capabilities, config Config) (publicationOptions, error) {
+	options := publicationOptions{ViaPartitionRoot: config.PublishViaPartitionRoot}
+	if options.ViaPartitionRoot && caps.ServerVersion < 130000 {
+		return options, fmt.Errorf("publish_via_partition_root needs PostgreSQL 13 or later")
+	}
+
+	for _, operation := range config.PublishOperations {
+		// TRUNCATE is only replicated since PostgreSQL 11
+		if operation == "truncate" && caps.ServerVersion < 110000 {
+			continue
+		}
+		options.Publish = append(options.Publish, operation)
+	}
+	return options, nil
+}
+
+func (o publicationOptions) publishes(operation string) bool {
+	for _, published := range o.Publish {
+		if published == operation {
+			return true
+		}
+	}
+	return false
+}
+
+// The options as shown in reports
+func (o publicationOptions) String() string {
+	return fmt.Sprintf("publish = '%s', publish_via_partition_root = %t", strings.Join(o.Publish, ", "), o.ViaPartitionRoot)
+}
+
+// The contents of the WITH clause of CREATE and ALTER PUBLICATION
+func (o publicationOptions) with(serverVersion int) string {
+	with := "publish = " + quoteLiteral(strings.Join(o.Publish, ", "))
+	if serverVersion >= 130000 {
+		with += fmt.Sprintf(", publish_via_partition_root = %t", o.ViaPartitionRoot)
+	}
+	return with
+}
+
+func (o publicationOptions) equal(other publicationOptions) bool {
+	return o.String() == other.String()
+}
+
+// Read the effective options of a publication from pg_publication
+func queryPublicationOptions(db *sql.DB, publicationName string) (publicationOptions, error) {
+	var options publicationOptions
+
+	var serverVersion int
+	if err := db.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&serverVersion); err != nil {
+		return options, fmt.Errorf("failed to check server version: %v", err)
+	}
+
+	// pubtruncate exists since PostgreSQL 11, pubviaroot since 13
+	truncate, viaRoot := "false", "false"
+	if serverVersion >= 110000 {
+		truncate = "pubtruncate"
+	}
+	if serverVersion >= 130000 {
+		viaRoot = "pubviaroot"
+	}
+
+	flags := make([]bool, len(publishOperations))
+	err := db.QueryRow(`
+		SELECT pubinsert, pubupdate, pubdelete, `+truncate+`, `+viaRoot+`
+		FROM pg_publication
+		WHERE pubname = $1
+	`, publicationName).Scan(&flags[0], &flags[1], &flags[2], &flags[3], &options.ViaPartitionRoot)
+	if err != nil {
+		return options, fmt.Errorf("failed to query publication options: %v", err)
+	}
+
+	for i, operation := range publishOperations {
+		if flags[i] {
+			options.Publish = append(options.Publish, operation)
+		}
+	}
+	return options, nil
+}
+
+// Set the options of an existing publication, reporting the effective ones
+func reconcilePublicationOptions(db *sql.DB, plan *Plan, caps Capabilities, publicationName string, options publicationOptions, result *strings.Builder) error {
+	current, err := queryPublicationOptions(db, publicationName)
+	if err != nil {
+		return err
+	}
+
+	if current.equal(options) {
+		result.WriteString(fmt.Sprintf("Publication options: %s.\n", current))
+		return nil
+	}
+
+	err = plan.exec(db, Change{
+		Step:   "Publication",
+		Action: "alter",
+		Object: fmt.Sprintf("publication %s options", publicationName),
+		From:   current.String(),
+		To:     options.String(),
+		SQL:    fmt.Sprintf("ALTER PUBLICATION %s SET (%s)", quoteIdent(publicationName), options.with(caps.ServerVersion)),
+	})
+	if err != nil {
+		return fmt.Errorf("failed to set publication options: %v", err)
+	}
+	result.WriteString(fmt.Sprintf("Changed publication options from %s to %s.\n", current, options))
+	return nil
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Every name and value that ends up in generated SQL goes through quoteIdent or
+// quoteLiteral. Names from the configuration are used exactly as written, so
+// mixed-case names and names with dashes or quotes refer to the object with
+// that exact name.
+
+// Quote an identifier such as a role, publication, schema or table name
+func quoteIdent(name string) string {
+	return pq.QuoteIdentifier(name)
+}
+
+// Quote a string literal such as a password or setting value
+func quoteLiteral(value string) string {
+	return pq.QuoteLiteral(value)
+}
+
+// A schema-qualified table name
+type tableName struct {
+	Schema string
+	Name   string
+}
+
+// The name as shown in reports
+func (t tableName) String() string {
+	return t.Schema + "." + t.Name
+}
+
+// The name as used in SQL statements
+func (t tableName) quoted() string {
+	return quoteIdent(t.Schema) + "." + quoteIdent(t.Name)
+}
+
+// Parse a table name from TABLES_TO_CAPTURE. Names without a schema are in the
+// public schema. A part can be wrapped in double quotes when it contains a dot,
+// with "" standing for a literal double quote.
+func parseTableName(name string) (tableName, error) {
+	parts, err := splitQualifiedName(name)
+	if err != nil {
+		return tableName{}, err
+	}
+
+	switch len(parts) {
+	case 1:
+		return tableName{Schema: "public", Name: parts[0]}, nil
+	case 2:
+		return tableName{Schema: parts[0], Name: parts[1]}, nil
+	}
+	return tableName{}, fmt.Errorf("invalid table name %q: expected table or schema.table", name)
+}
+
+func splitQualifiedName(name string) ([]string, error) {
+	parts, err := splitQualifiedNameParts(name)
+	if err != nil {
+		return nil, err
+	}
+	texts := make([]string, len(parts))
+	for i, part := range parts {
+		texts[i] = part.Text
+	}
+	return texts, nil
+}
+
+// A part of a qualified name and which of its bytes were inside double quotes
+type namePart struct {
+	Text   string
+	quoted []bool
+}
+
+func splitQualifiedNameParts(name string) ([]namePart, error) {
+	var parts []namePart
+	var part namePart
+	var text strings.Builder
+	quoted, inQuotes := false, false
+
+	add := func(c byte) {
+		text.WriteByte(c)
+		part.quoted = append(part.quoted, inQuotes)
+	}
+	finish := func() {
+		part.Text = text.String()
+		parts = append(parts, part)
+		part = namePart{}
+		text.Reset()
+		quoted = false
+	}
+
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		switch {
+		case inQuotes && c == '"' && i+1 < len(name) && name[i+1] == '"':
+			add('"')
+			i++
+		case c == '"' && (inQuotes || text.Len() == 0):
+			inQuotes = !inQuotes
+			quoted = true
+		case inQuotes:
+			add(c)
+		case c == '.':
+			if text.Len() == 0 && !quoted {
+				return nil, fmt.Errorf("invalid name %q: empty part", name)
+			}
+			finish()
+		case c == '"':
+			return nil, fmt.Errorf("invalid name %q: unexpected double quote", name)
+		default:
+			add(c)
+		}
+	}
+
+	if inQuotes {
+		return nil, fmt.Errorf("invalid name %q: unterminated double quote", name)
+	}
+	if text.Len() == 0 && !quoted {
+		return nil, fmt.Errorf("invalid name %q: empty part", name)
+	}
+	finish()
+	return parts, nil
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestQuoteIdent(t *testing.T) {
+	tests := []struct {
+		name, quoted string
+	}{
+		{"users", `"users"`},
+		{"MixedCase", `"MixedCase"`},
+		{"with-dash", `"with-dash"`},
+		{"dotted.name", `"dotted.name"`},
+		{`say "hi"`, `"say ""hi"""`},
+		{`x"; DROP TABLE users; --`, `"x""; DROP TABLE users; --"`},
+	}
+
+	for _, test := range tests {
+		if quoted := quoteIdent(test.name); quoted != test.quoted {
+			t.Errorf("quoteIdent(%q) = %s, want %s", test.name, quoted, test.quoted)
+		}
+	}
+}
+
+func TestQuoteLiteral(t *testing.T) {
+	tests := []struct {
+		value, quoted string
+	}{
+		{"secret", `'secret'`},
+		{"it's a secret", `'it''s a secret'`},
+		{`'; DROP ROLE postgres; --`, `'''; DROP ROLE postgres; --'`},
+		// A backslash switches to an escape string so that it stays literal
+		{`back\slash`, ` E'back\\slash'`},
+	}
+
+	for _, test := range tests {
+		if quoted := quoteLiteral(test.value); quoted != test.quoted {
+			t.Errorf("quoteLiteral(%q) = %s, want %s", test.value, quoted, test.quoted)
+		}
+	}
+}
+
+func TestParseTableName(t *testing.T) {
+	tests := []struct {
+		name   string
+		table  tableName
+		quoted string
+	}{
+		{"users", tableName{"public", "users"}, `"public"."users"`},
+		{"MixedCase", tableName{"public", "MixedCase"}, `"public"."MixedCase"`},
+		{"billing.with-dash", tableName{"billing", "with-dash"}, `"billing"."with-dash"`},
+		{`"Odd Schema"."dotted.name"`, tableName{"Odd Schema", "dotted.name"}, `"Odd Schema"."dotted.name"`},
+		{`"say ""hi"""`, tableName{"public", `say "hi"`}, `"public"."say ""hi"""`},
+		{"it's; DROP TABLE users; --", tableName{"public", "it's; DROP TABLE users; --"}, `"public"."it's; DROP TABLE users; --"`},
+	}
+
+	for _, test := range tests {
+		table, err := parseTableName(test.name)
+		if err != nil {
+			t.Errorf("parseTableName(%q) error = %v", test.name, err)
+			continue
+		}
+		if table != test.table {
+			t.Errorf("parseTableName(%q) = %#v, want %#v", test.name, table, test.table)
+		}
+		if quoted := table.quoted(); quoted != test.quoted {
+			t.Errorf("%#v.quoted() = %s, want %s", table, quoted, test.quoted)
+		}
+	}
+
+	for _, name := range []string{"", "a.b.c", ".users", "public.", `"unterminated`, `ab"c`} {
+		if _, err := parseTableName(name); err == nil {
+			t.Errorf("parseTableName(%q) succeeded, want an error", name)
+		}
+	}
+}
+
+func TestSplitQualifiedNameParts(t *testing.T) {
+	parts, err := splitQualifiedNameParts(`"a.b"*."*"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []namePart{
+		{Text: "a.b*", quoted: []bool{true, true, true, false}},
+		{Text: "*", quoted: []bool{true}},
+	}
+	if !reflect.DeepEqual(parts, want) {
+		t.Errorf("splitQualifiedNameParts = %#v, want %#v", parts, want)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+// Restarts the PostgreSQL server so that settings pending a restart take effect.
+// Drivers are opt-in through EXOQUIC_RESTART_DRIVER.
+type Restarter interface {
+	// Name of the driver for the log
+	Name() string
+	// Restart the server, returning once the restart was requested
+	Restart(ctx context.Context) error
+}
+
+// Create the restart driver selected in the configuration, nil if none is
+func newRestarter(config Config) (Restarter, error) {
+	switch config.RestartDriver {
+	case "", "none":
+		return nil, nil
+	case "docker":
+		if config.DockerContainer == "" && config.DockerLabel == "" {
+			return nil, fmt.Errorf("the docker restart driver needs EXOQUIC_DOCKER_CONTAINER or EXOQUIC_DOCKER_LABEL")
+		}
+		return newDockerRestarter(config.DockerSocket, config.DockerContainer, config.DockerLabel), nil
+	case "systemd":
+		unit := config.SystemdUnit
+		if unit == "" {
+			unit = "postgresql"
+		}
+		return commandRestarter{name: "systemd", command: []string{"systemctl", "restart", unit}}, nil
+	case "pg_ctl":
+		if config.PGData == "" {
+			return nil, fmt.Errorf("the pg_ctl restart driver needs PGDATA")
+		}
+		pgCtl := config.PGCtl
+		if pgCtl == "" {
+			pgCtl = "pg_ctl"
+		}
+		// Fast shutdown disconnects the sessions instead of waiting for them, -w waits until the server is up
+		return commandRestarter{name: "pg_ctl", command: []string{pgCtl, "restart", "-D", config.PGData, "-m", "fast", "-w"}}, nil
+	}
+	return nil, fmt.Errorf("unknown restart driver %q, expected docker, systemd, pg_ctl or none", config.RestartDriver)
+}
+
+// Restarts the server with a command on the database host, such as systemctl or pg_ctl
+type commandRestarter struct {
+	name    string
+	command []string
+}
+
+func (c commandRestarter) Name() string {
+	return c.name
+}
+
+func (c commandRestarter) Restart(ctx context.Context) error {
+	output, err := exec.CommandContext(ctx, c.command[0], c.command[1:]...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s failed: %v: %s", strings.Join(c.command, " "), err, strings.TrimSpace(string(output)))
+	}
+	return nil
+}
+
+// When the server was started, changes once it was restarted
+func postmasterStartTime(db *sql.DB) (time.Time, error) {
+	var startedAt time.Time
+	if err := db.QueryRow("SELECT pg_postmaster_start_time()").Scan(&startedAt); err != nil {
+		return startedAt, fmt.Errorf("failed to check server start time: %v", err)
+	}
+	return startedAt, nil
+}
+
+// Restart the server through the driver and wait until a new postmaster is
+// running, which proves that the restart actually happened. Without the start
+// time before the restart that proof is impossible, so the driver isn't run.
+func restartServer(ctx context.Context, restarter Restarter, config Config, startedAt time.Time) error {
+	if startedAt.IsZero() {
+		return fmt.Errorf("the server start time is unknown, so a restart through %s couldn't be verified", restarter.Name())
+	}
+	if err := restarter.Restart(ctx); err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(restartPollInterval)
+	defer ticker.Stop()
+
+	for {
+		db, err := connectOnce(ctx, config)
+		if err == nil {
+			var current time.Time
+			current, err = postmasterStartTime(db)
+			db.Close()
+			if err == nil && current.After(startedAt) {
+				log.Printf("The server was restarted at %s.", current.Format(time.RFC3339))
+				return nil
+			}
+		}
+
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("%s didn't restart the server, it is still running since %s", restarter.Name(), startedAt.Format(time.RFC3339))
+		case <-ticker.C:
+		}
+	}
+}
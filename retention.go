@@ -0,0 +1,213 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Cap the WAL a replication slot may retain, so that a slot Exoquic stops consuming can't fill the disk
+func configureWALRetention(db *sql.DB, plan *Plan, caps Capabilities, keepSize string) (string, error) {
+	var result strings.Builder
+
+	if caps.ServerVersion < 130000 {
+		result.WriteString("WARNING: max_slot_wal_keep_size needs PostgreSQL 13 or later, an unconsumed slot retains WAL without limit.\n")
+		return result.String(), nil
+	}
+
+	// All three settings are in MB
+	settings, err := querySettings(db, []string{"max_slot_wal_keep_size", "wal_keep_size", "max_wal_size"})
+	if err != nil {
+		return "", fmt.Errorf("failed to check WAL retention settings: %v", err)
+	}
+	currentMB, err := settings["max_slot_wal_keep_size"].intValue()
+	if err != nil {
+		return "", err
+	}
+	walKeepMB, err := settings["wal_keep_size"].intValue()
+	if err != nil {
+		return "", err
+	}
+	maxWalSizeMB, err := settings["max_wal_size"].intValue()
+	if err != nil {
+		return "", err
+	}
+
+	result.WriteString(fmt.Sprintf("INFO: max_slot_wal_keep_size is %s.\n", formatMB(currentMB)))
+	result.WriteString(fmt.Sprintf("INFO: wal_keep_size is %s.\n", formatMB(walKeepMB)))
+
+	// Listing the WAL directory needs pg_monitor, the size is only informational
+	var walDirSize int64
+	if err := db.QueryRow("SELECT COALESCE(sum(size), 0) FROM pg_ls_waldir()").Scan(&walDirSize); err == nil {
+		result.WriteString(fmt.Sprintf("INFO: The WAL directory currently holds %s.\n", formatMB(int(walDirSize/(1024*1024)))))
+	}
+
+	if keepSize == "" {
+		if currentMB < 0 {
+			recommendedMB := 4 * maxWalSizeMB
+			if recommendedMB < 10*1024 {
+				recommendedMB = 10 * 1024
+			}
+			result.WriteString("WARNING: Replication slots may retain WAL without limit. If Exoquic stops consuming, the slot can fill the disk.\n")
+			result.WriteString(fmt.Sprintf("Set EXOQUIC_MAX_SLOT_WAL_KEEP_SIZE to cap it, for example to %s, well below the free disk space.\n", formatMB(recommendedMB)))
+		}
+		return result.String(), nil
+	}
+
+	desiredMB, err := parseSlotWALKeepSize(keepSize, func(size string) (int64, error) { return querySizeBytes(db, size) })
+	if err != nil {
+		return "", err
+	}
+	if desiredMB == currentMB {
+		return result.String(), nil
+	}
+
+	change := Change{
+		Step:   "WAL Retention",
+		Action: "alter",
+		Object: "setting max_slot_wal_keep_size",
+		From:   formatMB(currentMB),
+		To:     formatMB(desiredMB),
+		SQL:    fmt.Sprintf("ALTER SYSTEM SET max_slot_wal_keep_size = '%dMB'", desiredMB),
+		undo:   fmt.Sprintf("ALTER SYSTEM SET max_slot_wal_keep_size = '%dMB'", currentMB),
+	}
+	if desiredMB < 0 {
+		change.SQL = "ALTER SYSTEM SET max_slot_wal_keep_size = -1"
+	}
+	if currentMB < 0 {
+		change.undo = "ALTER SYSTEM SET max_slot_wal_keep_size = -1"
+	}
+
+	if !caps.AlterSystem || caps.Provider.Managed() {
+		plan.manual("WAL Retention", "cap the WAL retained by replication slots", caps.Provider.walInstructions([]settingChange{
+			{Name: "max_slot_wal_keep_size", From: fmt.Sprintf("%d", currentMB), To: fmt.Sprintf("%d", desiredMB), SQL: change.SQL},
+		}))
+		result.WriteString(fmt.Sprintf("MANUAL: max_slot_wal_keep_size must be changed from %s to %s.\n", formatMB(currentMB), formatMB(desiredMB)))
+		return result.String(), nil
+	}
+
+	if err := plan.exec(db, change); err != nil {
+		return "", fmt.Errorf("failed to set max_slot_wal_keep_size: %v", err)
+	}
+
+	// The setting only needs a reload
+	err = plan.exec(db, Change{
+		Step:   "WAL Retention",
+		Action: "reload",
+		Object: "server configuration",
+		SQL:    "SELECT pg_reload_conf()",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to reload PostgreSQL configuration: %v", err)
+	}
+	result.WriteString(fmt.Sprintf("CHANGED: max_slot_wal_keep_size from %s to %s.\n", formatMB(currentMB), formatMB(desiredMB)))
+
+	return result.String(), nil
+}
+
+// Parse a size such as 10GB with pg_size_bytes, so that every size setting
+// accepts the units the server does
+func querySizeBytes(db *sql.DB, size string) (int64, error) {
+	var bytes int64
+	err := db.QueryRow("SELECT pg_size_bytes($1)", strings.TrimSpace(size)).Scan(&bytes)
+	return bytes, err
+}
+
+// Convert EXOQUIC_MAX_SLOT_WAL_KEEP_SIZE to MB, -1 for unlimited. sizeBytes
+// parses a size such as 10GB the way the server does. Sizes below 1MB are
+// rejected, the server would round them down to 0, which invalidates a slot as
+// soon as it falls behind.
+func parseSlotWALKeepSize(keepSize string, sizeBytes func(string) (int64, error)) (int, error) {
+	keepSize = strings.TrimSpace(keepSize)
+	if keepSize == "-1" {
+		return -1, nil
+	}
+
+	bytes, err := sizeBytes(keepSize)
+	if err != nil {
+		return 0, fmt.Errorf("invalid EXOQUIC_MAX_SLOT_WAL_KEEP_SIZE %q: %v", keepSize, err)
+	}
+	if bytes < 1024*1024 {
+		return 0, fmt.Errorf("EXOQUIC_MAX_SLOT_WAL_KEEP_SIZE must be at least 1MB, or -1 for unlimited, got %q", keepSize)
+	}
+	return int(bytes / (1024 * 1024)), nil
+}
+
+// How much WAL a replication slot retains and whether it is at risk of invalidation
+type slotRetention struct {
+	WALStatus     string        // reserved, extended, unreserved or lost
+	SafeWALSize   sql.NullInt64 // bytes that can still be written before the slot is invalidated, NULL without a cap
+	RetainedBytes int64
+	// Less than max_wal_size left before the slot is invalidated
+	AtRisk bool
+}
+
+// Query the retention of the slot, ok is false before PostgreSQL 13 or if the slot doesn't exist
+func querySlotRetention(db *sql.DB, slotName string) (slotRetention, bool, error) {
+	var s slotRetention
+
+	var serverVersion int
+	if err := db.QueryRow("SELECT current_setting('server_version_num')::int").Scan(&serverVersion); err != nil {
+		return s, false, fmt.Errorf("failed to check server version: %v", err)
+	}
+	if serverVersion < 130000 {
+		return s, false, nil
+	}
+
+	var walStatus sql.NullString
+	err := db.QueryRow(`
+		SELECT wal_status, safe_wal_size,
+			COALESCE(pg_wal_lsn_diff(
+				CASE WHEN pg_is_in_recovery() THEN pg_last_wal_receive_lsn() ELSE pg_current_wal_lsn() END,
+				restart_lsn), 0)::bigint,
+			COALESCE(safe_wal_size < pg_size_bytes(current_setting('max_wal_size')), false)
+		FROM pg_replication_slots
+		WHERE slot_name = $1
+	`, slotName).Scan(&walStatus, &s.SafeWALSize, &s.RetainedBytes, &s.AtRisk)
+	if err == sql.ErrNoRows {
+		return s, false, nil
+	}
+	if err != nil {
+		return s, false, fmt.Errorf("failed to query slot retention: %v", err)
+	}
+	s.WALStatus = walStatus.String
+
+	return s, true, nil
+}
+
+// Describe the danger the slot is in, empty if there is none
+func (s slotRetention) warning() string {
+	switch s.WALStatus {
+	case "lost":
+		return "the slot was invalidated because it retained too much WAL, drop and recreate it and resync Exoquic"
+	case "unreserved":
+		return "the slot exceeds max_slot_wal_keep_size and will be invalidated at the next checkpoint unless Exoquic catches up"
+	}
+	if s.AtRisk {
+		return fmt.Sprintf("only %s of WAL can be written before the slot is invalidated", formatBytes(s.SafeWALSize.Int64))
+	}
+	return ""
+}
+
+func formatMB(mb int) string {
+	switch {
+	case mb < 0:
+		return "unlimited"
+	case mb > 0 && mb%1024 == 0:
+		return fmt.Sprintf("%dGB", mb/1024)
+	}
+	return fmt.Sprintf("%dMB", mb)
+}
+
+func formatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit; n /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(bytes)/float64(div), "KMGTPE"[exp])
+}
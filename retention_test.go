@@ -0,0 +1,59 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// Parse the sizes used in the tests like pg_size_bytes
+func fakeSizeBytes(size string) (int64, error) {
+	units := map[string]int64{"kB": 1024, "MB": 1024 * 1024, "GB": 1024 * 1024 * 1024}
+	for suffix, factor := range units {
+		if strings.HasSuffix(size, suffix) {
+			var n int64
+			if _, err := fmt.Sscanf(strings.TrimSuffix(size, suffix), "%d", &n); err != nil {
+				return 0, err
+			}
+			return n * factor, nil
+		}
+	}
+	var n int64
+	if _, err := fmt.Sscanf(size, "%d", &n); err != nil {
+		return 0, fmt.Errorf("invalid size: %q", size)
+	}
+	return n, nil
+}
+
+func TestParseSlotWALKeepSize(t *testing.T) {
+	tests := []struct {
+		keepSize string
+		mb       int
+		err      string
+	}{
+		{keepSize: "-1", mb: -1},
+		{keepSize: " -1 ", mb: -1},
+		{keepSize: "10GB", mb: 10 * 1024},
+		{keepSize: "1MB", mb: 1},
+		{keepSize: "1536kB", mb: 1},
+		{keepSize: "512kB", err: "at least 1MB"},
+		{keepSize: "0", err: "at least 1MB"},
+		{keepSize: "-5MB", err: "at least 1MB"},
+		{keepSize: "lots", err: "invalid EXOQUIC_MAX_SLOT_WAL_KEEP_SIZE"},
+	}
+
+	for _, test := range tests {
+		mb, err := parseSlotWALKeepSize(test.keepSize, fakeSizeBytes)
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("parseSlotWALKeepSize(%q) error = %v, want %q", test.keepSize, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("parseSlotWALKeepSize(%q) error = %v", test.keepSize, err)
+		} else if mb != test.mb {
+			t.Errorf("parseSlotWALKeepSize(%q) = %d, want %d", test.keepSize, mb, test.mb)
+		}
+	}
+}
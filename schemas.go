@@ -0,0 +1,189 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Schemas that hold no user data. exoquic is handled by its own steps.
+const systemSchemaFilter = `
+	nspname NOT IN ('information_schema', 'exoquic')
+		AND nspname NOT LIKE 'pg\_%'
+`
+
+// Schemas that providers and extensions create for their own tables, such as
+// Supabase's auth users. They are only captured when EXOQUIC_SCHEMAS lists them.
+var providerSchemas = []string{
+	// Supabase
+	"auth", "storage", "realtime", "_realtime", "_analytics", "graphql", "graphql_public",
+	"vault", "pgsodium", "pgsodium_masks", "supabase_functions", "supabase_migrations",
+	"extensions", "net", "pgbouncer",
+	// pg_cron and PostGIS
+	"cron", "tiger", "tiger_data", "topology",
+}
+
+// Read a comma-separated list from the environment, empty entries are dropped
+func envList(name string) []string {
+	var values []string
+	for _, value := range strings.Split(os.Getenv(name), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+// Whether the schemas to capture were narrowed down, in which case FOR ALL
+// TABLES would publish too much
+func (c Config) schemaFilter() bool {
+	return len(c.Schemas) > 0 || len(c.ExcludeSchemas) > 0
+}
+
+// Resolve the schemas every step works on: the included schemas, or every
+// non-system schema except the provider schemas, minus the excluded ones. Also
+// returns the provider schemas that were left out.
+func resolveSchemas(db *sql.DB, config Config) ([]string, []string, error) {
+	rows, err := db.Query("SELECT nspname FROM pg_namespace WHERE" + systemSchemaFilter + "ORDER BY nspname")
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to query schemas: %v", err)
+	}
+	defer rows.Close()
+
+	existing := make(map[string]bool)
+	var all []string
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		existing[schema] = true
+		all = append(all, schema)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	var candidates, leftOut []string
+	if len(config.Schemas) > 0 {
+		for _, schema := range config.Schemas {
+			if !existing[schema] {
+				return nil, nil, fmt.Errorf("schema %s from EXOQUIC_SCHEMAS does not exist or is a system schema", schema)
+			}
+		}
+		candidates = config.Schemas
+	} else {
+		provider := make(map[string]bool)
+		for _, schema := range providerSchemas {
+			provider[schema] = true
+		}
+		for _, schema := range all {
+			if provider[schema] {
+				leftOut = append(leftOut, schema)
+			} else {
+				candidates = append(candidates, schema)
+			}
+		}
+	}
+
+	excluded := make(map[string]bool)
+	for _, schema := range config.ExcludeSchemas {
+		excluded[schema] = true
+	}
+
+	var schemas []string
+	for _, schema := range candidates {
+		if !excluded[schema] {
+			schemas = append(schemas, schema)
+		}
+	}
+	if len(schemas) == 0 {
+		return nil, nil, fmt.Errorf("no schemas left to capture after applying EXOQUIC_SCHEMAS and EXOQUIC_EXCLUDE_SCHEMAS")
+	}
+	return schemas, leftOut, nil
+}
+
+// Describe the schemas in reports, such as "schemas app, billing"
+func describeSchemas(schemas []string) string {
+	if len(schemas) == 1 {
+		return "schema " + schemas[0]
+	}
+	return "schemas " + strings.Join(schemas, ", ")
+}
+
+// Get the tables in the schemas. Partitions are left out, their partitioned
+// table is published instead.
+func schemaTables(db *sql.DB, schemas []string) ([]tableName, error) {
+	rows, err := db.Query(`
+		SELECT n.nspname, c.relname
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE c.relkind IN ('r', 'p')
+			AND NOT c.relispartition
+			AND n.nspname = ANY($1)
+		ORDER BY n.nspname, c.relname
+	`, pq.Array(schemas))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query tables: %v", err)
+	}
+	defer rows.Close()
+
+	var tables []tableName
+	for rows.Next() {
+		var table tableName
+		if err := rows.Scan(&table.Schema, &table.Name); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		tables = append(tables, table)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	return tables, nil
+}
+
+// Get the schemas the role has privileges on, explicitly or as default privileges
+// of new tables, so that teardown also revokes grants from earlier configurations
+func grantedSchemas(db *sql.DB, username string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT n.nspname
+		FROM pg_namespace n
+		WHERE`+systemSchemaFilter+`
+			AND (
+				has_schema_privilege($1, n.oid, 'USAGE')
+				OR EXISTS (
+					SELECT 1
+					FROM pg_default_acl d
+					CROSS JOIN aclexplode(d.defaclacl) a
+					JOIN pg_roles r ON r.oid = a.grantee
+					WHERE d.defaclnamespace = n.oid AND r.rolname = $1
+				)
+			)
+		ORDER BY n.nspname
+	`, username)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query schemas granted to %s: %v", username, err)
+	}
+	defer rows.Close()
+
+	var schemas []string
+	for rows.Next() {
+		var schema string
+		if err := rows.Scan(&schema); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		schemas = append(schemas, schema)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	return schemas, nil
+}
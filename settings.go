@@ -0,0 +1,101 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Server settings configured for logical replication
+var walSettingNames = []string{"wal_level", "max_replication_slots", "max_wal_senders"}
+
+// A server setting as reported by pg_settings
+type serverSetting struct {
+	Name    string
+	Setting string // value the server is running with
+	// A changed value in the configuration files only takes effect after a restart
+	PendingRestart bool
+	Context        string // postmaster settings need a restart, sighup settings a reload
+	SourceFile     string // empty unless the current user may read it
+}
+
+// Read the given settings from pg_settings
+func querySettings(db *sql.DB, names []string) (map[string]serverSetting, error) {
+	rows, err := db.Query(`
+		SELECT name, setting, pending_restart, context, COALESCE(sourcefile, '')
+		FROM pg_settings
+		WHERE name = ANY($1)
+	`, pq.Array(names))
+	if err != nil {
+		return nil, fmt.Errorf("failed to query settings: %v", err)
+	}
+	defer rows.Close()
+
+	settings := make(map[string]serverSetting)
+	for rows.Next() {
+		var s serverSetting
+		if err := rows.Scan(&s.Name, &s.Setting, &s.PendingRestart, &s.Context, &s.SourceFile); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		settings[s.Name] = s
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	for _, name := range names {
+		if _, ok := settings[name]; !ok {
+			return nil, fmt.Errorf("setting %s not found", name)
+		}
+	}
+
+	return settings, nil
+}
+
+// The settings whose new value waits for a server restart, in the order of names
+func pendingRestart(db *sql.DB, names []string) ([]serverSetting, error) {
+	settings, err := querySettings(db, names)
+	if err != nil {
+		return nil, err
+	}
+	return pendingSettings(settings, names), nil
+}
+
+func pendingSettings(settings map[string]serverSetting, names []string) []serverSetting {
+	var pending []serverSetting
+	for _, name := range names {
+		if settings[name].PendingRestart {
+			pending = append(pending, settings[name])
+		}
+	}
+	return pending
+}
+
+func (s serverSetting) intValue() (int, error) {
+	value, err := strconv.Atoi(s.Setting)
+	if err != nil {
+		return 0, fmt.Errorf("invalid value %q for %s: %v", s.Setting, s.Name, err)
+	}
+	return value, nil
+}
+
+// Describe a pending setting, including where it was changed when known
+func (s serverSetting) describePending() string {
+	description := fmt.Sprintf("%s (running with %s, %s context)", s.Name, s.Setting, s.Context)
+	if s.SourceFile != "" {
+		description += ", current value from " + s.SourceFile
+	}
+	return description
+}
+
+func describePendingSettings(pending []serverSetting) string {
+	names := make([]string, len(pending))
+	for i, s := range pending {
+		names[i] = s.Name
+	}
+	return strings.Join(names, ", ")
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Record the names of the Exoquic objects and the expected settings in
+// exoquic.settings, where the helper views read them
+func recordExoquicSettings(db *sql.DB, plan *Plan, config Config) (string, error) {
+	var result strings.Builder
+
+	// In a dry run of a new installation the migrations haven't created the table
+	var settingsExists bool
+	err := db.QueryRow("SELECT to_regclass('exoquic.settings') IS NOT NULL").Scan(&settingsExists)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if settings table exists: %v", err)
+	}
+
+	targets, err := computeWALTargets(db, config.SlotName, config.walTuning())
+	if err != nil {
+		return "", err
+	}
+	settings := []struct{ key, value string }{
+		{"slot_name", config.SlotName},
+		{"publication_name", config.PublicationName},
+		{"replication_user", config.ReplicationUser},
+		{"expected_max_replication_slots", fmt.Sprintf("%d", targets.MaxReplicationSlots)},
+		{"expected_max_wal_senders", fmt.Sprintf("%d", targets.MaxWalSenders)},
+	}
+
+	current := make(map[string]string)
+	if settingsExists {
+		rows, err := db.Query("SELECT key, value FROM exoquic.settings")
+		if err != nil {
+			return "", fmt.Errorf("failed to query settings: %v", err)
+		}
+		defer rows.Close()
+
+		for rows.Next() {
+			var key, value string
+			if err := rows.Scan(&key, &value); err != nil {
+				return "", fmt.Errorf("failed to scan row: %v", err)
+			}
+			current[key] = value
+		}
+
+		if err := rows.Err(); err != nil {
+			return "", fmt.Errorf("error iterating over rows: %v", err)
+		}
+	}
+
+	for _, setting := range settings {
+		value, ok := current[setting.key]
+		if ok && value == setting.value {
+			continue
+		}
+		err = plan.exec(db, Change{
+			Step:   "Exoquic Schema",
+			Action: "alter",
+			Object: "exoquic.settings " + setting.key,
+			From:   value,
+			To:     setting.value,
+			SQL: fmt.Sprintf("INSERT INTO exoquic.settings (key, value) VALUES (%s, %s) ON CONFLICT (key) DO UPDATE SET value = EXCLUDED.value",
+				quoteLiteral(setting.key), quoteLiteral(setting.value)),
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to record setting %s: %v", setting.key, err)
+		}
+		result.WriteString(fmt.Sprintf("Recorded setting %s = %s.\n", setting.key, setting.value))
+	}
+
+	return result.String(), nil
+}
@@ -0,0 +1,311 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Which columns and rows of a table are published, PostgreSQL 15+
+type tableSpec struct {
+	Columns []string `json:"columns"` // empty publishes every column
+	Where   string   `json:"where"`   // row filter, empty publishes every row
+}
+
+// Parse EXOQUIC_TABLE_SPECS, a JSON object from table name to spec such as
+// {"public.users": {"columns": ["id", "email"], "where": "NOT deleted"}}
+func parseTableSpecs(value string) (map[tableName]tableSpec, error) {
+	if strings.TrimSpace(value) == "" {
+		return nil, nil
+	}
+
+	var raw map[string]tableSpec
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, fmt.Errorf("EXOQUIC_TABLE_SPECS must be a JSON object from table name to spec: %v", err)
+	}
+
+	specs := make(map[tableName]tableSpec, len(raw))
+	for name, spec := range raw {
+		table, err := parseTableName(name)
+		if err != nil {
+			return nil, fmt.Errorf("EXOQUIC_TABLE_SPECS: %v", err)
+		}
+		if _, ok := specs[table]; ok {
+			return nil, fmt.Errorf("EXOQUIC_TABLE_SPECS: table %s is listed twice", table)
+		}
+		spec.Where = strings.TrimSpace(spec.Where)
+		specs[table] = spec
+	}
+	return specs, nil
+}
+
+// The column list and WHERE clause following the table name in CREATE and
+// ALTER PUBLICATION
+func (s tableSpec) sql() string {
+	var clause strings.Builder
+	if len(s.Columns) > 0 {
+		quoted := make([]string, len(s.Columns))
+		for i, column := range s.Columns {
+			quoted[i] = quoteIdent(column)
+		}
+		clause.WriteString(" (" + strings.Join(quoted, ", ") + ")")
+	}
+	if s.Where != "" {
+		clause.WriteString(" WHERE (" + s.Where + ")")
+	}
+	return clause.String()
+}
+
+// The spec as shown in reports
+func (s tableSpec) String() string {
+	columns, rows := "all columns", "all rows"
+	if len(s.Columns) > 0 {
+		columns = "columns " + strings.Join(s.Columns, ", ")
+	}
+	if s.Where != "" {
+		rows = "rows where " + s.Where
+	}
+	return columns + ", " + rows
+}
+
+// Whether two specs publish the same columns and rows. The order of a column
+// list doesn't matter, row filters are compared as deparsed by the server.
+func (s tableSpec) equal(other tableSpec) bool {
+	if len(s.Columns) != len(other.Columns) || s.Where != other.Where {
+		return false
+	}
+	a := append([]string{}, s.Columns...)
+	b := append([]string{}, other.Columns...)
+	sort.Strings(a)
+	sort.Strings(b)
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// The replica identity of a table and the columns it is made of
+type replicaIdentity struct {
+	Full    bool
+	Columns map[string]bool
+}
+
+// Check the specs of the published tables before the publication is touched.
+// The server only rejects an uncovered replica identity when an UPDATE or
+// DELETE runs, so that is checked here when those are published. Returns the
+// specs with their row filters deparsed the way pg_publication_rel stores them,
+// or as written when checkFilters is false.
+func checkTableSpecs(db *sql.DB, caps Capabilities, specs map[tableName]tableSpec, tables []tableName, checkFilters, publishesUpdates bool) (map[tableName]tableSpec, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	if caps.ServerVersion < 150000 {
+		return nil, fmt.Errorf("column lists and row filters in EXOQUIC_TABLE_SPECS need PostgreSQL 15 or later")
+	}
+
+	published := make(map[tableName]bool)
+	for _, table := range tables {
+		published[table] = true
+	}
+
+	checked := make(map[tableName]tableSpec, len(specs))
+	identities := make(map[tableName]replicaIdentity, len(specs))
+	var filtered []tableName
+	for table, spec := range specs {
+		if !published[table] {
+			return nil, fmt.Errorf("EXOQUIC_TABLE_SPECS has a spec for %s, which isn't published", table)
+		}
+
+		columns, identity, err := tableColumns(db, table)
+		if err != nil {
+			return nil, err
+		}
+		for _, column := range spec.Columns {
+			if !columns[column] {
+				return nil, fmt.Errorf("column %s in the column list of %s does not exist", column, table)
+			}
+		}
+
+		if publishesUpdates && len(spec.Columns) > 0 {
+			listed := make(map[string]bool)
+			for _, column := range spec.Columns {
+				listed[column] = true
+			}
+			if identity.Full {
+				// With REPLICA IDENTITY FULL every column is part of the identity
+				identity.Columns = columns
+			}
+			var missing []string
+			for column := range identity.Columns {
+				if !listed[column] {
+					missing = append(missing, column)
+				}
+			}
+			if len(missing) > 0 {
+				sort.Strings(missing)
+				return nil, fmt.Errorf("the column list of %s must include the replica identity columns %s, or updates and deletes fail",
+					table, strings.Join(missing, ", "))
+			}
+		}
+
+		checked[table] = spec
+		identities[table] = identity
+		if spec.Where != "" {
+			filtered = append(filtered, table)
+		}
+	}
+
+	if len(filtered) == 0 || !checkFilters {
+		return checked, nil
+	}
+	sortTableNames(filtered)
+
+	filters, err := deparseRowFilters(db, filtered, checked)
+	if err != nil {
+		return nil, err
+	}
+	for _, table := range filtered {
+		filter := filters[table]
+		if identity := identities[table]; publishesUpdates && !identity.Full {
+			for _, column := range filter.Columns {
+				if !identity.Columns[column] {
+					return nil, fmt.Errorf("the row filter of %s references %s, which is not part of the replica identity, so updates and deletes fail",
+						table, column)
+				}
+			}
+		}
+
+		spec := checked[table]
+		spec.Where = filter.Where
+		checked[table] = spec
+	}
+	return checked, nil
+}
+
+// Get the columns of a table and its replica identity. A table without a
+// primary key counts as REPLICA IDENTITY FULL, which apply sets later.
+func tableColumns(db *sql.DB, table tableName) (map[string]bool, replicaIdentity, error) {
+	identity := replicaIdentity{Columns: make(map[string]bool)}
+
+	var relreplident string
+	var hasPrimaryKey bool
+	var columnNames, identityNames []string
+	err := db.QueryRow(`
+		SELECT c.relreplident,
+			EXISTS(SELECT 1 FROM pg_constraint WHERE conrelid = c.oid AND contype = 'p'),
+			ARRAY(SELECT attname FROM pg_attribute
+				WHERE attrelid = c.oid AND attnum > 0 AND NOT attisdropped ORDER BY attnum),
+			ARRAY(SELECT a.attname
+				FROM pg_index i
+				JOIN pg_attribute a ON a.attrelid = i.indrelid AND a.attnum = ANY(i.indkey::int2[])
+				WHERE i.indrelid = c.oid
+					AND ((c.relreplident = 'd' AND i.indisprimary) OR (c.relreplident = 'i' AND i.indisreplident)))
+		FROM pg_class c
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE n.nspname = $1 AND c.relname = $2
+	`, table.Schema, table.Name).Scan(&relreplident, &hasPrimaryKey, pq.Array(&columnNames), pq.Array(&identityNames))
+	if err == sql.ErrNoRows {
+		return nil, identity, fmt.Errorf("table %s does not exist", table)
+	}
+	if err != nil {
+		return nil, identity, fmt.Errorf("failed to query columns of %s: %v", table, err)
+	}
+
+	columns := make(map[string]bool)
+	for _, column := range columnNames {
+		columns[column] = true
+	}
+	for _, column := range identityNames {
+		identity.Columns[column] = true
+	}
+	identity.Full = relreplident == "f" || (relreplident == "d" && !hasPrimaryKey)
+	return columns, identity, nil
+}
+
+// A row filter as stored by the server and the columns it references
+type rowFilter struct {
+	Where   string
+	Columns []string
+}
+
+// Let the server parse the row filters by creating a scratch publication in a
+// transaction that is rolled back, so nothing is ever committed. Invalid
+// filters fail here with the server's error message. The statement is
+// prepared, which sends it with the extended protocol: that rejects several
+// commands, so a filter can't end the transaction and run statements of its own.
+// The deparsed filters returned are single expressions, safe to use in the
+// statements apply runs.
+func deparseRowFilters(db *sql.DB, tables []tableName, specs map[tableName]tableSpec) (map[tableName]rowFilter, error) {
+	const scratch = "exoquic_row_filter_check"
+
+	objects := make([]string, len(tables))
+	for i, table := range tables {
+		objects[i] = table.quoted() + tableSpec{Where: specs[table].Where}.sql()
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	stmt, err := tx.Prepare(fmt.Sprintf("CREATE PUBLICATION %s FOR TABLE %s", quoteIdent(scratch), strings.Join(objects, ", ")))
+	if err != nil {
+		return nil, fmt.Errorf("failed to check the row filters in EXOQUIC_TABLE_SPECS: %v", err)
+	}
+	defer stmt.Close()
+	if _, err := stmt.Exec(); err != nil {
+		return nil, fmt.Errorf("failed to check the row filters in EXOQUIC_TABLE_SPECS: %v", err)
+	}
+
+	// The publication depends on every column its row filters reference
+	rows, err := tx.Query(`
+		SELECT n.nspname, c.relname, COALESCE(pg_get_expr(pr.prqual, pr.prrelid), ''),
+			ARRAY(SELECT a.attname
+				FROM pg_depend d
+				JOIN pg_attribute a ON a.attrelid = d.refobjid AND a.attnum = d.refobjsubid
+				WHERE d.classid = 'pg_publication_rel'::regclass AND d.objid = pr.oid AND d.refobjsubid > 0
+				ORDER BY a.attnum)
+		FROM pg_publication_rel pr
+		JOIN pg_publication p ON p.oid = pr.prpubid
+		JOIN pg_class c ON c.oid = pr.prrelid
+		JOIN pg_namespace n ON n.oid = c.relnamespace
+		WHERE p.pubname = $1
+	`, scratch)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query row filters: %v", err)
+	}
+	defer rows.Close()
+
+	filters := make(map[tableName]rowFilter)
+	for rows.Next() {
+		var table tableName
+		var filter rowFilter
+		if err := rows.Scan(&table.Schema, &table.Name, &filter.Where, pq.Array(&filter.Columns)); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		filters[table] = filter
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	// A filter that closed its parentheses could have changed which tables the publication lists
+	if len(filters) != len(tables) {
+		return nil, fmt.Errorf("the row filters in EXOQUIC_TABLE_SPECS must each be a single expression")
+	}
+	for _, table := range tables {
+		if filters[table].Where == "" {
+			return nil, fmt.Errorf("the row filter of %s in EXOQUIC_TABLE_SPECS must be a single expression", table)
+		}
+	}
+
+	return filters, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"strings"
+)
+
+// Record the statements that undo the changes in the plan. Values recorded by an
+// earlier apply are kept, so teardown always restores the original state.
+func recordPreviousState(db *sql.DB, plan *Plan) error {
+	for _, change := range plan.Changes {
+		if change.undo == "" {
+			continue
+		}
+
+		_, err := db.Exec(`
+			INSERT INTO exoquic.previous_state (object, restore_sql)
+			VALUES ($1, $2)
+			ON CONFLICT (object) DO NOTHING
+		`, change.Object, change.undo)
+		if err != nil {
+			return fmt.Errorf("failed to record previous state of %s: %v", change.Object, err)
+		}
+	}
+	return nil
+}
+
+// Restore the settings and replica identities recorded by apply. wal_level is
+// only restored when no logical replication slot is left, the server refuses
+// to start with logical slots below wal_level logical.
+func restorePreviousState(db *sql.DB, plan *Plan, slotName string) (string, error) {
+	var result strings.Builder
+
+	var tableExists bool
+	err := db.QueryRow("SELECT to_regclass('exoquic.previous_state') IS NOT NULL").Scan(&tableExists)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if previous state table exists: %v", err)
+	}
+
+	if !tableExists {
+		return "No previous state was recorded, nothing to restore.\n", nil
+	}
+
+	rows, err := db.Query("SELECT object, restore_sql FROM exoquic.previous_state ORDER BY recorded_at, object")
+	if err != nil {
+		return "", fmt.Errorf("failed to query previous state: %v", err)
+	}
+	defer rows.Close()
+
+	type state struct{ object, restoreSQL string }
+	var states []state
+	for rows.Next() {
+		var s state
+		if err := rows.Scan(&s.object, &s.restoreSQL); err != nil {
+			return "", fmt.Errorf("failed to scan row: %v", err)
+		}
+		states = append(states, s)
+	}
+
+	if err := rows.Err(); err != nil {
+		return "", fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	if len(states) == 0 {
+		return "No previous state was recorded, nothing to restore.\n", nil
+	}
+
+	// In a dry run the slot of this configuration wasn't dropped, but would be by now
+	ignoredSlot := ""
+	if plan.DryRun {
+		ignoredSlot = slotName
+	}
+	logicalSlots, err := logicalSlotNames(db, ignoredSlot)
+	if err != nil {
+		return "", err
+	}
+
+	settingsRestored := false
+	for _, s := range states {
+		if s.object == "setting wal_level" && len(logicalSlots) > 0 {
+			result.WriteString(fmt.Sprintf("WARNING: Not restoring wal_level, the logical replication slot(s) %s would stop the server from starting. Drop them and run teardown -restore again.\n",
+				strings.Join(logicalSlots, ", ")))
+			continue
+		}
+
+		err := plan.exec(db, Change{
+			Step:   "Restore",
+			Action: "alter",
+			Object: s.object,
+			SQL:    s.restoreSQL,
+		})
+		if err != nil {
+			result.WriteString(fmt.Sprintf("ERROR: Failed to restore %s: %v\n", s.object, err))
+			continue
+		}
+		result.WriteString(fmt.Sprintf("Restored %s.\n", s.object))
+		if strings.HasPrefix(s.restoreSQL, "ALTER SYSTEM") {
+			settingsRestored = true
+		}
+	}
+
+	if settingsRestored {
+		err = plan.exec(db, Change{
+			Step:   "Restore",
+			Action: "reload",
+			Object: "server configuration",
+			SQL:    "SELECT pg_reload_conf()",
+		})
+		if err != nil {
+			result.WriteString(fmt.Sprintf("ERROR: Failed to reload PostgreSQL configuration: %v\n", err))
+		}
+		result.WriteString("\nWARNING: Restored WAL settings only take effect after a server restart.\n")
+	}
+
+	return result.String(), nil
+}
+
+// Get the logical replication slots on the server except the ignored one
+func logicalSlotNames(db *sql.DB, ignored string) ([]string, error) {
+	rows, err := db.Query(`
+		SELECT slot_name FROM pg_replication_slots
+		WHERE slot_type = 'logical' AND slot_name <> $1
+		ORDER BY slot_name
+	`, ignored)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query logical replication slots: %v", err)
+	}
+	defer rows.Close()
+
+	var names []string
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, fmt.Errorf("failed to scan row: %v", err)
+		}
+		names = append(names, name)
+	}
+
+	if err := rows.Err(); err != nil {
+		return nil, fmt.Errorf("error iterating over rows: %v", err)
+	}
+
+	return names, nil
+}
+
+// Drop replication slot
+func dropReplicationSlot(db *sql.DB, plan *Plan, slotName string) (string, error) {
+	var active bool
+	err := db.QueryRow("SELECT active FROM pg_replication_slots WHERE slot_name = $1", slotName).Scan(&active)
+	if err == sql.ErrNoRows {
+		return fmt.Sprintf("Replication slot %s does not exist.\n", slotName), nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to check if replication slot exists: %v", err)
+	}
+
+	if active {
+		return "", fmt.Errorf("replication slot %s is in use, stop the consumer before tearing down", slotName)
+	}
+
+	err = plan.exec(db, Change{
+		Step:   "Replication Slot",
+		Action: "drop",
+		Object: "replication slot " + slotName,
+		SQL:    fmt.Sprintf("SELECT pg_drop_replication_slot(%s)", quoteLiteral(slotName)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to drop replication slot: %v", err)
+	}
+
+	return fmt.Sprintf("Dropped replication slot %s.\n", slotName), nil
+}
+
+// Drop publication
+func dropPublication(db *sql.DB, plan *Plan, publicationName string) (string, error) {
+	var publicationExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_publication WHERE pubname = $1)", publicationName).Scan(&publicationExists)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if publication exists: %v", err)
+	}
+
+	if !publicationExists {
+		return fmt.Sprintf("Publication %s does not exist.\n", publicationName), nil
+	}
+
+	err = plan.exec(db, Change{
+		Step:   "Publication",
+		Action: "drop",
+		Object: "publication " + publicationName,
+		SQL:    fmt.Sprintf("DROP PUBLICATION %s", quoteIdent(publicationName)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to drop publication: %v", err)
+	}
+
+	return fmt.Sprintf("Dropped publication %s.\n", publicationName), nil
+}
+
+// Drop the exoquic.status view and the exoquic schema with its remaining helper objects
+func dropExoquicSchema(db *sql.DB, plan *Plan) (string, error) {
+	var result strings.Builder
+
+	var schemaExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_namespace WHERE nspname = 'exoquic')").Scan(&schemaExists)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if schema exists: %v", err)
+	}
+
+	if !schemaExists {
+		return "Schema exoquic does not exist.\n", nil
+	}
+
+	var viewExists bool
+	err = db.QueryRow("SELECT to_regclass('exoquic.status') IS NOT NULL").Scan(&viewExists)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if status view exists: %v", err)
+	}
+
+	if viewExists {
+		err = plan.exec(db, Change{
+			Step:   "Exoquic Schema",
+			Action: "drop",
+			Object: "view exoquic.status",
+			SQL:    "DROP VIEW exoquic.status",
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to drop status view: %v", err)
+		}
+		result.WriteString("Dropped view exoquic.status.\n")
+	}
+
+	err = plan.exec(db, Change{
+		Step:   "Exoquic Schema",
+		Action: "drop",
+		Object: "schema exoquic",
+		SQL:    "DROP SCHEMA exoquic CASCADE",
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to drop exoquic schema: %v", err)
+	}
+	result.WriteString("Dropped schema exoquic and its helper objects.\n")
+
+	return result.String(), nil
+}
+
+// Revoke the grants made by createReplicationUser and drop the role
+func dropReplicationUser(db *sql.DB, plan *Plan, username string) (string, error) {
+	var result strings.Builder
+
+	var userExists bool
+	err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM pg_roles WHERE rolname = $1)", username).Scan(&userExists)
+	if err != nil {
+		return "", fmt.Errorf("failed to check if user exists: %v", err)
+	}
+
+	if !userExists {
+		return fmt.Sprintf("Replication user %s does not exist.\n", username), nil
+	}
+
+	// The replication user never owns objects, if it does someone else is using it
+	var ownedObjects int
+	err = db.QueryRow(`
+		SELECT count(*) FROM pg_class
+		WHERE relowner = (SELECT oid FROM pg_roles WHERE rolname = $1)
+	`, username).Scan(&ownedObjects)
+	if err != nil {
+		return "", fmt.Errorf("failed to check objects owned by %s: %v", username, err)
+	}
+	if ownedObjects > 0 {
+		return "", fmt.Errorf("role %s owns %d relation(s), reassign them before tearing down", username, ownedObjects)
+	}
+
+	// Revoke in every schema the role was granted on, the captured schemas may have changed since
+	schemas, err := grantedSchemas(db, username)
+	if err != nil {
+		return "", err
+	}
+
+	var revokes []struct{ object, sql string }
+	for _, schema := range schemas {
+		revokes = append(revokes, []struct{ object, sql string }{
+			{
+				fmt.Sprintf("default SELECT on new tables in schema %s from %s", schema, username),
+				fmt.Sprintf("ALTER DEFAULT PRIVILEGES IN SCHEMA %s REVOKE SELECT ON TABLES FROM %s", quoteIdent(schema), quoteIdent(username)),
+			},
+			{
+				fmt.Sprintf("SELECT on all tables in schema %s from %s", schema, username),
+				fmt.Sprintf("REVOKE SELECT ON ALL TABLES IN SCHEMA %s FROM %s", quoteIdent(schema), quoteIdent(username)),
+			},
+			{
+				fmt.Sprintf("USAGE on schema %s from %s", schema, username),
+				fmt.Sprintf("REVOKE USAGE ON SCHEMA %s FROM %s", quoteIdent(schema), quoteIdent(username)),
+			},
+		}...)
+	}
+	for _, revoke := range revokes {
+		err = plan.exec(db, Change{
+			Step:   "Replication User",
+			Action: "revoke",
+			Object: revoke.object,
+			SQL:    revoke.sql,
+		})
+		if err != nil {
+			return "", fmt.Errorf("failed to revoke %s: %v", revoke.object, err)
+		}
+	}
+	result.WriteString(fmt.Sprintf("Revoked permissions from %s.\n", username))
+
+	err = plan.exec(db, Change{
+		Step:   "Replication User",
+		Action: "drop",
+		Object: "role " + username,
+		SQL:    fmt.Sprintf("DROP ROLE %s", quoteIdent(username)),
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to drop replication user: %v", err)
+	}
+	result.WriteString(fmt.Sprintf("Dropped replication user %s.\n", username))
+
+	return result.String(), nil
+}
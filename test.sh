@@ -17,16 +17,64 @@ until docker exec exoquic-postgres pg_isready -U postgres &> /dev/null; do
 done
 echo "PostgreSQL is ready"
 
-# Create test tables
-docker exec -i exoquic-postgres psql -U postgres -d exoquic_test << EOF
+# Create test tables, including names that only work when quoted
+docker exec -i exoquic-postgres psql -U postgres -d exoquic_test << 'EOF'
 CREATE TABLE test_data (id SERIAL, name TEXT, value INTEGER);
 CREATE TABLE with_pk (id SERIAL PRIMARY KEY, name TEXT);
+CREATE TABLE "MixedCase" (id SERIAL, name TEXT);
+CREATE TABLE "with-dash" (id SERIAL, name TEXT);
+CREATE TABLE "it's; DROP TABLE with_pk; --" (id SERIAL, name TEXT);
+CREATE SCHEMA "Odd Schema";
+CREATE TABLE "Odd Schema"."dotted.name" (id SERIAL PRIMARY KEY, name TEXT);
 
 INSERT INTO test_data (name, value) VALUES ('Test 1', 100), ('Test 2', 200);
 INSERT INTO with_pk (name) VALUES ('PK 1'), ('PK 2');
 EOF
 
-# Run the configurator
+# Plan with hostile role, publication, password and table names. Every name
+# must come out quoted in the generated SQL.
+PGHOST=localhost \
+PGPORT=5432 \
+PGUSER=postgres \
+PGPASSWORD=postgres \
+PGDATABASE=exoquic_test \
+EXOQUIC_REPLICATION_USER='Exoquic-User' \
+EXOQUIC_REPLICATION_PASSWORD="it's a \"secret\"" \
+EXOQUIC_PUBLICATION_NAME='exoquic-publication' \
+TABLES_TO_CAPTURE='test_data,MixedCase,with-dash,it'"'"'s; DROP TABLE with_pk; --,"Odd Schema"."dotted.name"' \
+go run . plan -output json > /tmp/exoquic-plan.json
+
+for expected in \
+  'CREATE ROLE \"Exoquic-User\"' \
+  'CREATE PUBLICATION \"exoquic-publication\" FOR TABLE \"Odd Schema\".\"dotted.name\", \"public\".\"MixedCase\", \"public\".\"it'"'"'s; DROP TABLE with_pk; --\", \"public\".\"test_data\", \"public\".\"with-dash\"' \
+  'ALTER TABLE \"public\".\"it'"'"'s; DROP TABLE with_pk; --\" REPLICA IDENTITY FULL'; do
+  if ! grep -qF "$expected" /tmp/exoquic-plan.json; then
+    echo "Plan is missing: $expected"
+    exit 1
+  fi
+done
+if grep -qF 'secret' /tmp/exoquic-plan.json; then
+  echo "Plan contains the replication password"
+  exit 1
+fi
+echo "Hostile names are quoted"
+
+# Stand in for the Exoquic registration API, which apply calls on localhost:9090
+python3 - << 'EOF' &
+from http.server import BaseHTTPRequestHandler, HTTPServer
+
+class Handler(BaseHTTPRequestHandler):
+    def do_PUT(self):
+        self.rfile.read(int(self.headers.get("Content-Length", 0)))
+        self.send_response(200)
+        self.end_headers()
+
+HTTPServer(("localhost", 9090), Handler).serve_forever()
+EOF
+api_pid=$!
+trap 'kill $api_pid' EXIT
+
+# Run the configurator. wal_level needs a restart, which the docker driver does.
 PGHOST=localhost \
 PGPORT=5432 \
 PGUSER=postgres \
@@ -34,7 +82,20 @@ PGPASSWORD=postgres \
 PGDATABASE=exoquic_test \
 EXOQUIC_REPLICATION_USER=exoquic_user \
 EXOQUIC_REPLICATION_PASSWORD=exoquic_password \
-EXOQUIC_API_KEY= \
-go run main.go
+EXOQUIC_API_KEY=test-api-key \
+EXOQUIC_ENV=dev \
+EXOQUIC_RESTART_DRIVER=docker \
+EXOQUIC_DOCKER_CONTAINER=exoquic-postgres \
+EXOQUIC_RESTART_TIMEOUT=2m \
+go run .
+
+# The restart and the slot created after it must leave a complete configuration
+PGHOST=localhost \
+PGPORT=5432 \
+PGUSER=postgres \
+PGPASSWORD=postgres \
+PGDATABASE=exoquic_test \
+EXOQUIC_REPLICATION_USER=exoquic_user \
+go run . verify
 
 echo "Done. To clean up, run: docker stop exoquic-postgres && docker rm exoquic-postgres"
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+)
+
+// Replication slots and WAL senders Exoquic itself uses
+const exoquicSlots = 1
+
+// How the targets for max_replication_slots and max_wal_senders are chosen
+type walTuning struct {
+	Headroom            int // spare slots and senders on top of the ones in use
+	MaxReplicationSlots int // fixed target instead of the computed one, 0 to compute
+	MaxWalSenders       int // fixed target instead of the computed one, 0 to compute
+}
+
+// The values max_replication_slots and max_wal_senders should have at least
+type walTargets struct {
+	MaxReplicationSlots int
+	MaxWalSenders       int
+	// Why a target differs from what was asked for
+	Notes []string
+}
+
+// Compute the targets from the slots and senders in use besides Exoquic's own,
+// plus what Exoquic needs, plus headroom
+func computeWALTargets(db *sql.DB, slotName string, tuning walTuning) (walTargets, error) {
+	var targets walTargets
+
+	var otherSlots, otherSenders, maxConnections, serverVersion int
+	err := db.QueryRow(`
+		SELECT
+			(SELECT count(*) FROM pg_replication_slots WHERE slot_name <> $1),
+			(SELECT count(*) FROM pg_stat_replication r
+				WHERE NOT EXISTS (SELECT 1 FROM pg_replication_slots s WHERE s.slot_name = $1 AND s.active_pid = r.pid)),
+			current_setting('max_connections')::int,
+			current_setting('server_version_num')::int
+	`, slotName).Scan(&otherSlots, &otherSenders, &maxConnections, &serverVersion)
+	if err != nil {
+		return targets, fmt.Errorf("failed to check replication usage: %v", err)
+	}
+
+	targets.MaxReplicationSlots = otherSlots + exoquicSlots + tuning.Headroom
+	if tuning.MaxReplicationSlots > 0 {
+		targets.MaxReplicationSlots = tuning.MaxReplicationSlots
+		if tuning.MaxReplicationSlots < otherSlots+exoquicSlots {
+			targets.Notes = append(targets.Notes, fmt.Sprintf("max_replication_slots target %d leaves no slot for Exoquic, %d slots are already in use",
+				tuning.MaxReplicationSlots, otherSlots))
+		}
+	}
+
+	// Every slot in use can have a sender, physical replicas may stream without a slot
+	inUse := otherSlots
+	if otherSenders > inUse {
+		inUse = otherSenders
+	}
+	targets.MaxWalSenders = inUse + exoquicSlots + tuning.Headroom
+	if tuning.MaxWalSenders > 0 {
+		targets.MaxWalSenders = tuning.MaxWalSenders
+		if tuning.MaxWalSenders < inUse+exoquicSlots {
+			targets.Notes = append(targets.Notes, fmt.Sprintf("max_wal_senders target %d leaves no sender for Exoquic, %d senders are already in use",
+				tuning.MaxWalSenders, inUse))
+		}
+	}
+
+	// Before PG12 the senders count against max_connections, and the server refuses to start unless there are fewer
+	if serverVersion < 120000 && targets.MaxWalSenders >= maxConnections {
+		targets.Notes = append(targets.Notes, fmt.Sprintf("max_wal_senders target %d capped to %d to stay below max_connections (%d)",
+			targets.MaxWalSenders, maxConnections-1, maxConnections))
+		targets.MaxWalSenders = maxConnections - 1
+	}
+
+	return targets, nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"time"
+)
+
+// Exit codes of apply, so that CI jobs and deploys can tell the outcomes apart.
+// 2 is left out, the flag package and unknown commands exit with it.
+const (
+	exitFailed         = 1
+	exitRestartPending = 3
+)
+
+// Returned when the deadline passes before the server was restarted
+var errRestartPending = errors.New("server restart still pending")
+
+// How often the waiter checks the WAL settings
+const restartPollInterval = 3 * time.Second
+
+// Check whether the WAL settings are in effect. If not, the description says what is still missing.
+func walSettingsApplied(db *sql.DB) (bool, string, error) {
+	settings, err := querySettings(db, walSettingNames)
+	if err != nil {
+		return false, "", err
+	}
+
+	if pending := pendingSettings(settings, walSettingNames); len(pending) > 0 {
+		return false, "waiting for a server restart to apply " + describePendingSettings(pending), nil
+	}
+	if walLevel := settings["wal_level"].Setting; walLevel != "logical" {
+		return false, fmt.Sprintf("wal_level is '%s', not 'logical'", walLevel), nil
+	}
+	return true, "", nil
+}
+
+// Connect once, without the backoff of connectWithRetry, giving up when ctx is done
+func connectOnce(ctx context.Context, config Config) (*sql.DB, error) {
+	db, err := sql.Open("postgres", connectionString(config))
+	if err != nil {
+		return nil, err
+	}
+	if err := db.PingContext(ctx); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return db, nil
+}
+
+// Reconnect until the WAL settings are in effect and return the connection.
+// Returns errRestartPending when the deadline of ctx passes first, and the
+// context error when ctx is cancelled, for example by a signal.
+func waitForRestart(ctx context.Context, config Config) (*sql.DB, error) {
+	ticker := time.NewTicker(restartPollInterval)
+	defer ticker.Stop()
+
+	lastStatus := ""
+	for {
+		db, err := connectOnce(ctx, config)
+		if err != nil && ctx.Err() == nil {
+			// The server is expected to go away while it restarts
+			log.Printf("Could not connect to database, retrying: %v", err)
+		} else if err == nil {
+			applied, status, err := walSettingsApplied(db)
+			if err != nil {
+				log.Printf("Warning: Error checking WAL settings: %v", err)
+			} else if applied {
+				return db, nil
+			} else if status != lastStatus {
+				// Only log changes, the status is checked every few seconds
+				log.Printf("The configuration isn't in effect yet, %s.", status)
+				lastStatus = status
+			}
+			db.Close()
+		}
+
+		select {
+		case <-ctx.Done():
+			if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+				return nil, errRestartPending
+			}
+			return nil, ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}